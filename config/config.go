@@ -0,0 +1,233 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to the environment variable of every setting
+const EnvPrefix = "APP_"
+
+// Config is everything the server can be configured with
+type Config struct {
+	Addr     string   `yaml:"addr"`      // address the HTTP server listens on
+	LogLevel string   `yaml:"log_level"` // debug, info, warn or error
+	Database Database `yaml:"database"`
+	HTTP     HTTP     `yaml:"http"`
+}
+
+// Database configures the SQLite connection. The pragmas are applied to
+// every connection in the pool.
+type Database struct {
+	DSN         string        `yaml:"dsn"`
+	JournalMode string        `yaml:"journal_mode"` // e.g. WAL or DELETE
+	BusyTimeout time.Duration `yaml:"busy_timeout"` // how long to wait for a lock
+	ForeignKeys bool          `yaml:"foreign_keys"`
+}
+
+// HTTP configures the timeouts and size limits of the HTTP server
+type HTTP struct {
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"` // how long to drain on shutdown
+	ShutdownDelay     time.Duration `yaml:"shutdown_delay"`   // how long to fail readiness before draining
+	RequestTimeout    time.Duration `yaml:"request_timeout"`  // deadline of each request, 0 for none
+	IdempotencyTTL    time.Duration `yaml:"idempotency_ttl"`  // how long Idempotency-Key responses are replayed
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	MaxBodyBytes      int64         `yaml:"max_body_bytes"`
+}
+
+// Default returns the configuration used for settings that are not given
+func Default() Config {
+	return Config{
+		Addr:     ":8080",
+		LogLevel: "info",
+		Database: Database{
+			DSN:         "test.db",
+			JournalMode: "WAL",
+			BusyTimeout: 5 * time.Second,
+			ForeignKeys: true,
+		},
+		HTTP: HTTP{
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			ShutdownTimeout:   15 * time.Second,
+			RequestTimeout:    10 * time.Second,
+			IdempotencyTTL:    24 * time.Hour,
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      1 << 20,
+		},
+	}
+}
+
+// Load builds the configuration from, in increasing order of precedence:
+//
+// - the defaults
+// - the YAML or JSON file given by -config or APP_CONFIG, if any
+// - APP_* environment variables, e.g. APP_DB_BUSY_TIMEOUT for -db-busy-timeout
+// - command line flags
+//
+// The result is validated. lookupEnv is usually os.LookupEnv.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	// Parse the flags on their own first, to find the file and which flags
+	// were given
+	var scratch Config
+	flags := newFlagSet(&scratch)
+	path := flags.String("config", "", "path to a YAML or JSON config file (env "+EnvPrefix+"CONFIG)")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if *path == "" {
+		*path, _ = lookupEnv(EnvPrefix + "CONFIG")
+	}
+
+	cfg := Default()
+	if *path != "" {
+		if err := loadFile(*path, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Environment variables and flags are set through a flag set bound to cfg,
+	// so that both are parsed the same way
+	settings := newFlagSet(&cfg)
+	var errs []error
+	settings.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		if value, ok := lookupEnv(name); ok {
+			if err := settings.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			settings.Set(f.Name, f.Value.String())
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports every invalid setting
+func (c Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("addr: %w", err))
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log_level: must be one of debug, info, warn, error, got %q", c.LogLevel))
+	}
+	if c.Database.DSN == "" {
+		errs = append(errs, errors.New("database.dsn: must not be empty"))
+	}
+	switch strings.ToUpper(c.Database.JournalMode) {
+	case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		errs = append(errs, fmt.Errorf("database.journal_mode: must be one of DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF, got %q", c.Database.JournalMode))
+	}
+	if c.Database.BusyTimeout < 0 {
+		errs = append(errs, errors.New("database.busy_timeout: must not be negative"))
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.read_header_timeout", c.HTTP.ReadHeaderTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout},
+		{"http.idle_timeout", c.HTTP.IdleTimeout},
+		{"http.shutdown_timeout", c.HTTP.ShutdownTimeout},
+		{"http.shutdown_delay", c.HTTP.ShutdownDelay},
+		{"http.request_timeout", c.HTTP.RequestTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative", timeout.name))
+		}
+	}
+	// A request that outlives the write timeout cannot send its 503
+	if c.HTTP.WriteTimeout > 0 && c.HTTP.RequestTimeout >= c.HTTP.WriteTimeout {
+		errs = append(errs, errors.New("http.request_timeout: must be shorter than http.write_timeout"))
+	}
+	// The delay is part of the shutdown and must leave time to drain
+	if c.HTTP.ShutdownDelay > 0 && c.HTTP.ShutdownDelay >= c.HTTP.ShutdownTimeout {
+		errs = append(errs, errors.New("http.shutdown_delay: must be shorter than http.shutdown_timeout"))
+	}
+	if c.HTTP.IdempotencyTTL <= 0 {
+		errs = append(errs, errors.New("http.idempotency_ttl: must be positive"))
+	}
+	if c.HTTP.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("http.max_header_bytes: must be positive"))
+	}
+	if c.HTTP.MaxBodyBytes <= 0 {
+		errs = append(errs, errors.New("http.max_body_bytes: must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// newFlagSet returns a flag set whose flags write to cfg, with cfg's current
+// values as their defaults
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "address to listen on")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&cfg.Database.DSN, "db-dsn", cfg.Database.DSN, "SQLite database file or DSN")
+	fs.StringVar(&cfg.Database.JournalMode, "db-journal-mode", cfg.Database.JournalMode, "SQLite journal mode")
+	fs.DurationVar(&cfg.Database.BusyTimeout, "db-busy-timeout", cfg.Database.BusyTimeout, "how long SQLite waits for a lock")
+	fs.BoolVar(&cfg.Database.ForeignKeys, "db-foreign-keys", cfg.Database.ForeignKeys, "enforce foreign keys in SQLite")
+	fs.DurationVar(&cfg.HTTP.ReadTimeout, "read-timeout", cfg.HTTP.ReadTimeout, "maximum duration for reading a request")
+	fs.DurationVar(&cfg.HTTP.ReadHeaderTimeout, "read-header-timeout", cfg.HTTP.ReadHeaderTimeout, "maximum duration for reading request headers")
+	fs.DurationVar(&cfg.HTTP.WriteTimeout, "write-timeout", cfg.HTTP.WriteTimeout, "maximum duration for writing a response")
+	fs.DurationVar(&cfg.HTTP.IdleTimeout, "idle-timeout", cfg.HTTP.IdleTimeout, "how long idle keep-alive connections stay open")
+	fs.DurationVar(&cfg.HTTP.ShutdownTimeout, "shutdown-timeout", cfg.HTTP.ShutdownTimeout, "how long in-flight requests may finish on shutdown")
+	fs.DurationVar(&cfg.HTTP.ShutdownDelay, "shutdown-delay", cfg.HTTP.ShutdownDelay, "how long /readyz fails before draining starts on shutdown")
+	fs.DurationVar(&cfg.HTTP.RequestTimeout, "request-timeout", cfg.HTTP.RequestTimeout, "deadline of each request, except event streams and WebSockets")
+	fs.DurationVar(&cfg.HTTP.IdempotencyTTL, "idempotency-ttl", cfg.HTTP.IdempotencyTTL, "how long responses to requests with an Idempotency-Key are replayed")
+	fs.IntVar(&cfg.HTTP.MaxHeaderBytes, "max-header-bytes", cfg.HTTP.MaxHeaderBytes, "maximum size of request headers")
+	fs.Int64Var(&cfg.HTTP.MaxBodyBytes, "max-body-bytes", cfg.HTTP.MaxBodyBytes, "maximum size of request bodies")
+	return fs
+}
+
+// envName returns the environment variable for a flag, e.g. APP_DB_DSN for
+// db-dsn
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadFile decodes a YAML file into cfg. JSON is a subset of YAML, so JSON
+// files work too. Unknown keys are rejected so that typos are not ignored.
+func loadFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
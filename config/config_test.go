@@ -0,0 +1,158 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang-http-patch/config"
+)
+
+// env returns a lookup function over a fixed set of variables
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := config.Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := config.Default()
+	if cfg != want {
+		t.Errorf("Expected defaults %+v, got %+v", want, cfg)
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+addr: ":7000"
+log_level: warn
+database:
+  dsn: file.db
+  busy_timeout: 2s
+http:
+  write_timeout: 20s
+`)
+
+	// Flags beat the environment, which beats the file, which beats defaults
+	cfg, err := config.Load(
+		[]string{"-config", path, "-addr", ":9000"},
+		env(map[string]string{"APP_ADDR": ":8000", "APP_DB_DSN": "env.db", "APP_DB_FOREIGN_KEYS": "false"}),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Addr != ":9000" {
+		t.Errorf("Expected the flag to win for addr, got %q", cfg.Addr)
+	}
+	if cfg.Database.DSN != "env.db" || cfg.Database.ForeignKeys {
+		t.Errorf("Expected the environment to win for the DSN and foreign keys, got %+v", cfg.Database)
+	}
+	if cfg.LogLevel != "warn" || cfg.Database.BusyTimeout != 2*time.Second || cfg.HTTP.WriteTimeout != 20*time.Second {
+		t.Errorf("Expected the file values, got %+v", cfg)
+	}
+	if cfg.Database.JournalMode != "WAL" || cfg.HTTP.ReadTimeout != config.Default().HTTP.ReadTimeout {
+		t.Errorf("Expected defaults for the rest, got %+v", cfg)
+	}
+}
+
+func TestLoad_JSONFileFromEnv(t *testing.T) {
+	path := writeFile(t, "config.json", `{"addr": "127.0.0.1:8081", "http": {"max_body_bytes": 4096}}`)
+
+	cfg, err := config.Load(nil, env(map[string]string{"APP_CONFIG": path}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Addr != "127.0.0.1:8081" || cfg.HTTP.MaxBodyBytes != 4096 {
+		t.Errorf("Expected the JSON file values, got %+v", cfg)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		file    string
+		wantErr []string
+	}{
+		{
+			name:    "invalid values",
+			args:    []string{"-addr", "8080", "-log-level", "verbose", "-db-journal-mode", "fast", "-max-body-bytes", "0"},
+			wantErr: []string{"addr:", "log_level:", "database.journal_mode:", "http.max_body_bytes:"},
+		},
+		{
+			name:    "negative timeout",
+			args:    []string{"-read-timeout", "-1s"},
+			wantErr: []string{"http.read_timeout: must not be negative"},
+		},
+		{
+			name:    "request timeout beyond write timeout",
+			args:    []string{"-request-timeout", "1m", "-write-timeout", "30s"},
+			wantErr: []string{"http.request_timeout: must be shorter than http.write_timeout"},
+		},
+		{
+			name:    "shutdown delay beyond shutdown timeout",
+			env:     map[string]string{"APP_SHUTDOWN_DELAY": "20s"},
+			wantErr: []string{"http.shutdown_delay: must be shorter than http.shutdown_timeout"},
+		},
+		{
+			name:    "zero idempotency TTL",
+			file:    "http:\n  idempotency_ttl: 0s\n",
+			wantErr: []string{"http.idempotency_ttl: must be positive"},
+		},
+		{
+			name:    "unparsable environment variable",
+			env:     map[string]string{"APP_DB_BUSY_TIMEOUT": "soon"},
+			wantErr: []string{"APP_DB_BUSY_TIMEOUT:"},
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-port", "8080"},
+			wantErr: []string{"flag provided but not defined: -port"},
+		},
+		{
+			name:    "unknown key in file",
+			file:    "adress: \":8080\"\n",
+			wantErr: []string{"field adress not found"},
+		},
+		{
+			name:    "missing file",
+			args:    []string{"-config", "does-not-exist.yaml"},
+			wantErr: []string{"does-not-exist.yaml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "-config", writeFile(t, "config.yaml", tt.file))
+			}
+			_, err := config.Load(args, env(tt.env))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error to contain %q, got %q", want, err)
+				}
+			}
+		})
+	}
+}
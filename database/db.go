@@ -1,29 +1,50 @@
 package database
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
 
+	"golang-http-patch/config"
+	"golang-http-patch/logging"
 	"golang-http-patch/models"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-var DB *gorm.DB
-
-// InitDB initializes the database connection and runs migrations
-func InitDB() {
-	var err error
-	DB, err = gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
+// Open connects to the SQLite database described by cfg and runs migrations.
+// Queries are logged to logger, see logging.GORMLogger.
+func Open(cfg config.Database, logger *slog.Logger) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(DSN(cfg)), &gorm.Config{
+		Logger: logging.NewGORMLogger(logger),
+	})
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		return nil, err
 	}
 
 	// Auto migrate the schema
-	err = models.AutoMigrate(DB)
-	if err != nil {
-		log.Fatal("Failed to migrate database:", err)
+	if err := models.AutoMigrate(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// DSN adds the pragmas of cfg to its DSN as connection parameters, so that
+// the driver applies them to every connection it opens
+func DSN(cfg config.Database) string {
+	params := url.Values{}
+	params.Set("_journal_mode", strings.ToUpper(cfg.JournalMode))
+	params.Set("_busy_timeout", fmt.Sprint(cfg.BusyTimeout.Milliseconds()))
+	params.Set("_foreign_keys", "0")
+	if cfg.ForeignKeys {
+		params.Set("_foreign_keys", "1")
 	}
 
-	log.Println("Database connected and migrated successfully")
+	separator := "?"
+	if strings.Contains(cfg.DSN, "?") {
+		separator = "&"
+	}
+	return cfg.DSN + separator + params.Encode()
 }
@@ -0,0 +1,53 @@
+package database_test
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang-http-patch/config"
+	"golang-http-patch/database"
+)
+
+func TestOpen_AppliesPragmas(t *testing.T) {
+	cfg := config.Database{
+		DSN:         filepath.Join(t.TempDir(), "app.db"),
+		JournalMode: "wal",
+		BusyTimeout: 2500 * time.Millisecond,
+		ForeignKeys: true,
+	}
+	db, err := database.Open(cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	// A second connection must get the pragmas too
+	sqlDB.SetMaxIdleConns(2)
+
+	for i := 0; i < 2; i++ {
+		conn, err := sqlDB.Conn(t.Context())
+		if err != nil {
+			t.Fatalf("Failed to get connection: %v", err)
+		}
+		defer conn.Close()
+
+		var journalMode string
+		var busyTimeout, foreignKeys int
+		conn.QueryRowContext(t.Context(), "PRAGMA journal_mode").Scan(&journalMode)
+		conn.QueryRowContext(t.Context(), "PRAGMA busy_timeout").Scan(&busyTimeout)
+		conn.QueryRowContext(t.Context(), "PRAGMA foreign_keys").Scan(&foreignKeys)
+		if journalMode != "wal" || busyTimeout != 2500 || foreignKeys != 1 {
+			t.Errorf("Connection %d: expected wal, 2500, 1, got %s, %d, %d", i, journalMode, busyTimeout, foreignKeys)
+		}
+	}
+}
+
+func TestDSN(t *testing.T) {
+	cfg := config.Database{DSN: "file:app.db?cache=shared", JournalMode: "DELETE", BusyTimeout: time.Second}
+	want := "file:app.db?cache=shared&_busy_timeout=1000&_foreign_keys=0&_journal_mode=DELETE"
+	if got := database.DSN(cfg); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,59 @@
+package events
+
+import (
+	"sync"
+
+	"golang-http-patch/models"
+)
+
+// bufferSize is how many events a subscriber may fall behind before it is
+// dropped
+const bufferSize = 64
+
+// Broker fans out committed user changes to live subscribers. Events are the
+// history entries of the changes, so subscribers that fall behind or
+// reconnect can catch up from the user_history table.
+type Broker struct {
+	mu   sync.Mutex
+	subs map[chan models.UserHistory]struct{}
+}
+
+// NewBroker returns a broker without subscribers
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[chan models.UserHistory]struct{})}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function that cancels the subscription. The channel is closed when
+// the subscription is cancelled or when the subscriber falls too far behind.
+func (b *Broker) Subscribe() (<-chan models.UserHistory, func()) {
+	ch := make(chan models.UserHistory, bufferSize)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends an event to all subscribers without blocking. It must only be
+// called after the change has been committed.
+func (b *Broker) Publish(entry models.UserHistory) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- entry:
+		default:
+			// Too slow: drop the subscriber, it can resume from the event log
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+	"golang-http-patch/repository"
+)
+
+// ConflictResponse is returned with 409 when a patch based on an older version
+// changes fields that were changed differently since then
+type ConflictResponse struct {
+	Error          string          `json:"error"`
+	CurrentVersion uint            `json:"current_version"`
+	Conflicts      []FieldConflict `json:"conflicts"`
+}
+
+// FieldConflict shows a conflicting field at the base version, now, and in
+// the rejected patch
+type FieldConflict struct {
+	Field     string `json:"field"`
+	Base      any    `json:"base"`
+	Current   any    `json:"current"`
+	Requested any    `json:"requested"`
+}
+
+// rebasePatch handles If-Match on PATCH. A patch written against the current
+// version is used as is. A patch written against an older version is merged
+// three-way with the changes made since: base is the user at that version,
+// ours the current user and theirs the base with the patch applied. Only true
+// conflicts are rejected with 409. current is the version of user. With
+// If-Match it also returns the version the returned patch is based on, which
+// the write must still find. It returns false when a response has already
+// been written.
+func (s *Server) rebasePatch(w http.ResponseWriter, r *http.Request, user models.User, current uint, dto models.PatchUserDTO) (models.PatchUserDTO, *uint, bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return dto, nil, true
+	}
+	if !s.validate(w, dto) {
+		return dto, nil, false
+	}
+
+	version, ok := parseETag(ifMatch)
+	if !ok {
+		http.Error(w, "Invalid If-Match header", http.StatusPreconditionFailed)
+		return dto, nil, false
+	}
+	if version == current {
+		return dto, &current, true
+	}
+	if version > current {
+		http.Error(w, "Unknown version", http.StatusPreconditionFailed)
+		return dto, nil, false
+	}
+
+	base, err := s.userAt(r.Context(), uint64(user.ID), func(entry models.UserHistory) bool {
+		return entry.Version > version
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "Unknown version", http.StatusPreconditionFailed)
+		} else {
+			serverError(w, r, err)
+		}
+		return dto, nil, false
+	}
+
+	theirs := base
+	if err := patch.Apply(&theirs, dto); err != nil {
+		serverError(w, r, err)
+		return dto, nil, false
+	}
+
+	merged, conflicts := patch.Merge3(base, user, theirs)
+	if len(conflicts) > 0 {
+		resp := ConflictResponse{
+			Error:          "Conflicting changes since version " + strconv.FormatUint(uint64(version), 10),
+			CurrentVersion: current,
+		}
+		for _, c := range conflicts {
+			resp.Conflicts = append(resp.Conflicts, FieldConflict{Field: c.Field, Base: c.Base, Current: c.Ours, Requested: c.Theirs})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(current))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(resp)
+		return dto, nil, false
+	}
+
+	rebased, err := patchFromChanges(patch.Diff(user, merged))
+	if err != nil {
+		serverError(w, r, err)
+		return dto, nil, false
+	}
+	if len(rebased.Updates()) == 0 {
+		// Everything in the patch is already part of the current version
+		s.writeUser(w, r, http.StatusOK, user, current)
+		return rebased, nil, false
+	}
+	return rebased, &current, true
+}
+
+// setETag sets the ETag header to a user version
+func setETag(w http.ResponseWriter, version uint) {
+	w.Header().Set("ETag", etag(version))
+}
+
+// etag formats a user version as an entity tag
+func etag(version uint) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseETag parses an entity tag produced by etag, weak or strong
+func parseETag(tag string) (uint, bool) {
+	tag = strings.TrimPrefix(tag, "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 32)
+	return uint(version), err == nil
+}
+
+// patchFromChanges decodes the new values of changes exactly like a PATCH body
+func patchFromChanges(changes patch.Changes) (models.PatchUserDTO, error) {
+	var dto models.PatchUserDTO
+	body, err := json.Marshal(changes.MergePatch())
+	if err != nil {
+		return dto, err
+	}
+	err = json.Unmarshal(body, &dto)
+	return dto, err
+}
@@ -2,15 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
-	"golang-http-patch/database"
 	"golang-http-patch/models"
-	"golang-http-patch/validation"
+	"golang-http-patch/repository"
 )
 
 // CreateUser handles POST /users - Create a new user
-func CreateUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
 	var dto models.CreateUserDTO
 	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -18,7 +19,7 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate DTO
-	if !validation.ValidateStruct(w, dto) {
+	if !s.validate(w, dto) {
 		return
 	}
 
@@ -36,15 +37,23 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	if dto.Role == "" {
 		user.Role = "user"
 	}
-	// Active defaults to true (handled by GORM default:true in schema)
+	// Active defaults to true. The DTO cannot tell an omitted field from false,
+	// so false is treated as omitted, as the default:true column always did.
+	if !dto.Active {
+		user.Active = true
+	}
 
-	result := database.DB.Create(&user)
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	entry, err := s.Users.Create(r.Context(), &user, actor(r))
+	if err != nil {
+		if errors.Is(err, repository.ErrEmailTaken) {
+			http.Error(w, "Email already in use", http.StatusConflict)
+		} else {
+			serverError(w, r, err)
+		}
 		return
 	}
+	s.publish(entry)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	w.Header().Set("Location", fmt.Sprintf("/users/%d", user.ID))
+	s.writeUser(w, r, http.StatusCreated, user, entry.Version)
 }
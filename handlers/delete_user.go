@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"golang-http-patch/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// DeleteUser handles DELETE /users/{id} - Delete a user
+func (s *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := s.Users.Delete(r.Context(), uint(id), actor(r))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+	s.publish(entry)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"golang-http-patch/idempotency"
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+	"golang-http-patch/repository"
+)
+
+// DryRunResponse is returned by PUT and PATCH when a dry run is requested
+type DryRunResponse struct {
+	DryRun bool          `json:"dry_run"`
+	User   models.User   `json:"user"`
+	Diff   patch.Changes `json:"diff"`
+}
+
+// previewUpdate previews dto on the user without writing it, then writes the
+// would-be user and the field-level diff
+func (s *Server) previewUpdate(w http.ResponseWriter, r *http.Request, id uint64, dto models.PatchUserDTO) {
+	before, after, err := s.Users.Preview(r.Context(), uint(id), dto)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+		case errors.Is(err, repository.ErrRequired):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			serverError(w, r, err)
+		}
+		return
+	}
+	s.writePreview(w, r, before, after)
+}
+
+// writePreview writes the would-be user and its field-level diff from before
+func (s *Server) writePreview(w http.ResponseWriter, r *http.Request, before, after models.User) {
+	// A preview changes nothing, so a retry without dry run must not replay it
+	idempotency.Discard(r.Context())
+
+	if _, ok := preferences(r)["dry-run"]; ok {
+		w.Header().Set("Preference-Applied", "dry-run")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DryRunResponse{
+		DryRun: true,
+		User:   after,
+		Diff:   patch.Diff(before, after),
+	})
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang-http-patch/models"
+)
+
+// replayBatchSize limits how many stored events are loaded at once on resume
+const replayBatchSize = 500
+
+// StreamUserEvents handles GET /users/events - Stream user changes as
+// Server-Sent Events.
+//
+// Every create, update, patch, delete and revert is sent after it has been
+// committed, as an event named after the operation whose id is the history
+// entry ID and whose data is the history entry, including the diff with
+// emails and phone numbers masked. A client
+// that reconnects with Last-Event-ID first receives the events it missed from
+// the repository's history.
+func (s *Server) StreamUserEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	resume := r.Header.Get("Last-Event-ID")
+	if resume != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(resume, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before replaying so that nothing committed in between is lost
+	live, cancel := s.Events.Subscribe()
+	defer cancel()
+
+	// The stream outlives the server's read and write timeouts
+	clearDeadlines(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// replayed is the last ID sent from the history. Live events up to
+	// it were replayed already; later ones are all sent, because concurrent
+	// writes may publish their events in a different order than their IDs.
+	var replayed uint64
+	if resume != "" {
+		for {
+			batch, err := s.Users.HistorySince(r.Context(), uint(lastID), replayBatchSize)
+			if err != nil {
+				s.Logger.ErrorContext(r.Context(), "Failed to replay user events", "error", err)
+				return
+			}
+			for _, entry := range batch {
+				if writeEvent(w, entry) != nil {
+					return
+				}
+				lastID = uint64(entry.ID)
+			}
+			replayed = lastID
+			flusher.Flush()
+			if len(batch) < replayBatchSize {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(s.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.draining:
+			return
+		case entry, ok := <-live:
+			if !ok {
+				// Dropped for falling behind; the client resumes with Last-Event-ID
+				return
+			}
+			if uint64(entry.ID) <= replayed {
+				continue // already replayed
+			}
+			if writeEvent(w, entry) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes a history entry in the SSE wire format. Like the history
+// endpoint, the stream is audit output, so emails and phone numbers in the
+// diff are masked.
+func writeEvent(w http.ResponseWriter, entry models.UserHistory) error {
+	entry.Diff = models.UserRedaction.Changes(entry.Diff)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", entry.ID, entry.Operation, data)
+	return err
+}
@@ -2,18 +2,19 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
-	"golang-http-patch/database"
 	"golang-http-patch/models"
+	"golang-http-patch/repository"
 
 	"github.com/gorilla/mux"
-	"gorm.io/gorm"
 )
 
 // GetUser handles GET /users/{id} - Get a single user
-func GetUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseUint(vars["id"], 10, 32)
 	if err != nil {
@@ -21,13 +22,43 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user models.User
-	result := database.DB.First(&user, id)
-	if result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
+	if r.URL.Query().Has("as_of") {
+		s.getUserAsOf(w, r, id)
+		return
+	}
+
+	user, version, err := s.Users.GetVersion(r.Context(), uint(id))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	setETag(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// getUserAsOf handles GET /users/{id}?as_of=<RFC 3339 timestamp> - Get a user
+// as it was at a point in time, reconstructed from the history
+func (s *Server) getUserAsOf(w http.ResponseWriter, r *http.Request, id uint64) {
+	asOf, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("as_of"))
+	if err != nil {
+		http.Error(w, "Invalid as_of timestamp, expected RFC 3339", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.userAt(r.Context(), id, func(entry models.UserHistory) bool {
+		return entry.CreatedAt.After(asOf)
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
 			http.Error(w, "User not found", http.StatusNotFound)
 		} else {
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			serverError(w, r, err)
 		}
 		return
 	}
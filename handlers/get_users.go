@@ -3,17 +3,13 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
-
-	"golang-http-patch/database"
-	"golang-http-patch/models"
 )
 
 // GetUsers handles GET /users - Get all users
-func GetUsers(w http.ResponseWriter, r *http.Request) {
-	var users []models.User
-	result := database.DB.Find(&users)
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+func (s *Server) GetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.Users.List(r.Context())
+	if err != nil {
+		serverError(w, r, err)
 		return
 	}
 
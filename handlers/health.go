@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang-http-patch/models"
+)
+
+// readinessTimeout bounds each readiness check, so that a hanging
+// dependency fails the check instead of the probe
+const readinessTimeout = 2 * time.Second
+
+// Check reports whether something the server depends on works
+type Check func(ctx context.Context) error
+
+// Check statuses
+const (
+	CheckOK   = "ok"
+	CheckFail = "fail"
+)
+
+// CheckResult is the outcome of one check
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthReport is returned by GET /healthz and GET /readyz. Status is ok
+// only if every check is.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// errShuttingDown fails readiness once a graceful shutdown has begun
+var errShuttingDown = errors.New("server is shutting down")
+
+// GetHealth handles GET /healthz - Report that the process is alive. It
+// checks no dependencies, so that a database outage does not get the process
+// restarted.
+func (s *Server) GetHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthReport{Status: CheckOK, Checks: map[string]CheckResult{}})
+}
+
+// GetReadiness handles GET /readyz - Report whether the server can take
+// traffic: the database is reachable and migrated, every check of
+// ReadinessChecks passes, and no shutdown has begun. Checks run concurrently,
+// each with a timeout, and the response is 503 if any fails.
+func (s *Server) GetReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]Check{
+		"database": func(ctx context.Context) error {
+			sqlDB, err := s.DB.DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		},
+		"migrations": func(ctx context.Context) error {
+			return models.CheckMigrations(s.db(ctx))
+		},
+		"shutdown": func(context.Context) error {
+			if s.ShuttingDown() {
+				return errShuttingDown
+			}
+			return nil
+		},
+	}
+	for name, check := range s.ReadinessChecks {
+		checks[name] = check
+	}
+
+	report := HealthReport{Status: CheckOK, Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			result := CheckResult{Status: CheckOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status, result.Error = CheckFail, models.UserRedaction.Text(err.Error())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = CheckFail
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if report.Status != CheckOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, report)
+}
+
+func writeHealth(w http.ResponseWriter, status int, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
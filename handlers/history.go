@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"golang-http-patch/models"
+	"golang-http-patch/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// ActorHeader names who is making a change; it is recorded in the history
+const ActorHeader = "X-Actor"
+
+// Pagination defaults for GET /users/{id}/history
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// HistoryPage is a page of history entries, newest first
+type HistoryPage struct {
+	Items    []models.UserHistory `json:"items"`
+	Page     int                  `json:"page"`
+	PageSize int                  `json:"page_size"`
+	Total    int64                `json:"total"`
+}
+
+// GetUserHistory handles GET /users/{id}/history - List changes to a user.
+// Emails and phone numbers in the diffs are masked.
+func (s *Server) GetUserHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	page, err := queryInt(r, "page", 1)
+	if err != nil || page < 1 {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	pageSize, err := queryInt(r, "page_size", defaultPageSize)
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		http.Error(w, "Invalid page_size", http.StatusBadRequest)
+		return
+	}
+
+	resp := HistoryPage{Page: page, PageSize: pageSize}
+	resp.Items, resp.Total, err = s.Users.History(r.Context(), uint(id), (page-1)*pageSize, pageSize)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Users that never had a recorded change must at least exist
+	if resp.Total == 0 {
+		if _, err := s.Users.Get(r.Context(), uint(id)); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				http.Error(w, "User not found", http.StatusNotFound)
+			} else {
+				serverError(w, r, err)
+			}
+			return
+		}
+	}
+	// The history is an audit trail: it shows what changed, not the
+	// personal data itself
+	for i := range resp.Items {
+		resp.Items[i].Diff = models.UserRedaction.Changes(resp.Items[i].Diff)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// userAt reconstructs a user as it was before the newest history entries for
+// which newer returns true, by rolling those entries back from the current
+// state. It returns repository.ErrNotFound if the user did not exist then.
+func (s *Server) userAt(ctx context.Context, id uint64, newer func(models.UserHistory) bool) (models.User, error) {
+	user, err := s.Users.Get(ctx, uint(id))
+	exists := err == nil
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return user, err
+	}
+
+	entries, _, err := s.Users.History(ctx, uint(id), 0, 0)
+	if err != nil {
+		return user, err
+	}
+
+	for _, entry := range entries {
+		if !newer(entry) {
+			break
+		}
+		if entry.Operation == models.OperationDelete {
+			user, exists = models.User{}, true
+		}
+		if err := entry.Diff.Reverse().ApplyTo(&user); err != nil {
+			return user, err
+		}
+		if entry.Operation == models.OperationCreate {
+			exists = false
+		}
+	}
+
+	if !exists {
+		return models.User{}, repository.ErrNotFound
+	}
+	return user, nil
+}
+
+// publish sends a committed history entry to event subscribers. Entries
+// with a zero ID stand for writes that changed nothing and are skipped.
+func (s *Server) publish(entry models.UserHistory) {
+	if entry.ID != 0 {
+		s.Events.Publish(entry)
+	}
+}
+
+// actor returns who is making the request, from the X-Actor header
+func actor(r *http.Request) string {
+	if a := r.Header.Get(ActorHeader); a != "" {
+		if len(a) > 100 {
+			a = a[:100]
+		}
+		return a
+	}
+	return "anonymous"
+}
+
+// queryInt reads an integer query parameter, returning def when it is absent
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
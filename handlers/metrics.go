@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"net/http"
+
+	"golang-http-patch/metrics"
+	"golang-http-patch/validation"
+)
+
+// GetMetrics handles GET /metrics - Expose the metrics in the Prometheus
+// text format
+func (s *Server) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	s.Metrics.Registry.WriteTo(w)
+}
+
+// validate validates value like validation.ValidateStruct, counting the
+// failed rules by field and tag
+func (s *Server) validate(w http.ResponseWriter, value any) bool {
+	err := s.Validate.Struct(value)
+	if err == nil {
+		return true
+	}
+	s.countValidationErrors(err)
+	validation.WriteErrors(w, err)
+	return false
+}
+
+func (s *Server) countValidationErrors(err error) {
+	for _, field := range validation.FieldErrors(err) {
+		s.Metrics.ValidationFailures.Inc(field["field"], field["tag"])
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"golang-http-patch/logging"
+	"golang-http-patch/models"
+	"golang-http-patch/problem"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// StatusClientClosedRequest is the non-standard status recorded for requests
+// that the client gave up on before they were answered
+const StatusClientClosedRequest = 499
+
+// Names of the routes that stay open and are exempt from RequestTimeout
+const (
+	routeUserEvents = "user-events"
+	routeWatchUser  = "watch-user"
+)
+
+// db returns the database bound to ctx, so that queries stop when the
+// request is cancelled or times out
+func (s *Server) db(ctx context.Context) *gorm.DB {
+	return s.DB.WithContext(ctx)
+}
+
+// serverError responds to an unexpected error, with the request ID so that
+// the error can be found in the logs. Errors caused by the request context
+// ending are not the server's fault: a request that ran out of time gets
+// 503 Service Unavailable and one the client abandoned gets 499. Database
+// errors may quote the values that caused them, so personal data is masked.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	message, status := models.UserRedaction.Text(err.Error()), http.StatusInternalServerError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		message, status = "Request timed out", http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		message, status = "Client closed request", StatusClientClosedRequest
+	}
+	if id := logging.RequestID(r.Context()); id != "" {
+		message = fmt.Sprintf("%s (request ID %s)", message, id)
+	}
+	http.Error(w, message, status)
+}
+
+// accessLog gives every request an ID, taken from X-Request-ID if the client
+// sent a valid one, and logs and counts the request once it has been
+// answered. The ID is echoed in the response and carried by the request
+// context, so that every log line of the request, including its queries,
+// has it.
+func (s *Server) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(logging.RequestIDHeader)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		r = r.WithContext(logging.WithRequestID(r.Context(), id))
+		w.Header().Set(logging.RequestIDHeader, id)
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Requests that matched no route are logged under a single name
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		elapsed := time.Since(start)
+		s.Metrics.ObserveRequest(methodLabel(r.Method), route, rec.status, elapsed)
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		s.Logger.LogAttrs(r.Context(), level, "Request",
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.Int("status", rec.status),
+			slog.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+			slog.Int64("bytes", rec.bytes),
+		)
+	})
+}
+
+// methodLabel returns method for the standard HTTP methods and "other" for
+// any other, since clients may send arbitrary method names
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// recoverPanics turns a panicking handler into a 500 problem response and
+// logs the panic with its stack and the request ID. If the response had
+// already started, the client cannot be told, so the connection is aborted.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec, ok := w.(*responseRecorder)
+		if !ok {
+			rec = &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v) // aborted on purpose, nothing to report
+			}
+			s.Logger.ErrorContext(r.Context(), "Panic",
+				slog.String("error", fmt.Sprint(v)),
+				slog.String("stack", string(debug.Stack())),
+			)
+			if rec.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+
+			// Drop whatever the handler had set, such as an ETag
+			header := rec.Header()
+			for key := range header {
+				if key != http.CanonicalHeaderKey(logging.RequestIDHeader) {
+					header.Del(key)
+				}
+			}
+			details := problem.New(http.StatusInternalServerError, "The server hit an unexpected error")
+			details.Instance = r.URL.Path
+			details.RequestID = logging.RequestID(r.Context())
+			problem.Write(rec, details)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// responseRecorder passes a response through while noting its status and
+// size. It can still be flushed and hijacked for event streams and
+// WebSockets.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	rec.wroteHeader = true
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil {
+		rec.status = http.StatusSwitchingProtocols
+		rec.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// withTimeout gives every request except event streams and WebSockets a
+// deadline of RequestTimeout
+func (s *Server) withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.RequestTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			if name := route.GetName(); name == routeUserEvents || name == routeWatchUser {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), s.RequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// limitBody rejects request bodies larger than MaxBodyBytes. Bodies without
+// a Content-Length are cut off at the limit, which makes decoding them fail.
+func (s *Server) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.MaxBodyBytes <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > s.MaxBodyBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clearDeadlines lifts the server's read and write timeouts for a long-lived
+// response such as an event stream or a WebSocket
+func clearDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
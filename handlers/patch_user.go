@@ -2,20 +2,19 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
-	"golang-http-patch/database"
 	"golang-http-patch/models"
 	"golang-http-patch/patch"
-	"golang-http-patch/validation"
+	"golang-http-patch/repository"
 
 	"github.com/gorilla/mux"
-	"gorm.io/gorm"
 )
 
 // PatchUser handles PATCH /users/{id} - Partially update a user
-func PatchUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PatchUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseUint(vars["id"], 10, 32)
 	if err != nil {
@@ -24,13 +23,12 @@ func PatchUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if user exists
-	var user models.User
-	result := database.DB.First(&user, id)
-	if result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
+	user, version, err := s.Users.GetVersion(r.Context(), uint(id))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
 			http.Error(w, "User not found", http.StatusNotFound)
 		} else {
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			serverError(w, r, err)
 		}
 		return
 	}
@@ -41,36 +39,90 @@ func PatchUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate DTO
-	if !validation.ValidateStruct(w, dto) {
+	// With update_mask the body is a full object and only the listed fields
+	// are applied, clearing those it leaves out
+	if r.URL.Query().Has("update_mask") {
+		mask := patch.ParseMask(r.URL.Query().Get("update_mask"))
+		if len(mask) == 0 {
+			http.Error(w, "update_mask must list at least one field", http.StatusBadRequest)
+			return
+		}
+		if err := patch.ApplyMask(&dto, mask); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.Metrics.ObservePatch(dto)
+
+	// A patch based on an older version is merged with the changes since
+	dto, ifVersion, ok := s.rebasePatch(w, r, user, version, dto)
+	if !ok {
 		return
 	}
 
-	// Build updates map only for provided fields
-	updates := make(map[string]interface{})
-	patch.SetUpdate(updates, "name", dto.Name)
-	patch.SetUpdate(updates, "age", dto.Age)
-	patch.SetUpdate(updates, "phone", dto.Phone)
-	patch.SetUpdate(updates, "active", dto.Active)
-	patch.SetUpdate(updates, "bio", dto.Bio)
-	patch.SetUpdate(updates, "role", dto.Role)
-	patch.SetUpdate(updates, "score", dto.Score)
-	// Email is immutable and cannot be updated
+	s.applyPatch(w, r, user, dto, models.OperationPatch, ifVersion)
+}
+
+// applyPatch validates dto and applies it to user, recording the change in
+// the history under operation. If ifVersion is not nil the user must still be
+// at that version when the change is written, or the request fails with 412.
+// It is shared by every handler that patches a user so that they all go
+// through the same validation.
+func (s *Server) applyPatch(w http.ResponseWriter, r *http.Request, user models.User, dto models.PatchUserDTO, operation string, ifVersion *uint) {
+	// Validate DTO
+	if !s.validate(w, dto) {
+		return
+	}
 
-	if len(updates) == 0 {
+	if len(dto.Updates()) == 0 {
 		http.Error(w, "No fields to update", http.StatusBadRequest)
 		return
 	}
 
-	result = database.DB.Model(&user).Updates(updates)
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	preview, err := dryRun(r)
+	if err != nil {
+		http.Error(w, "Invalid dry_run value", http.StatusBadRequest)
+		return
+	}
+	if preview {
+		s.previewUpdate(w, r, uint64(user.ID), dto)
+		return
+	}
+
+	user, entry, err := s.Users.Patch(r.Context(), user.ID, dto, operation, actor(r), ifVersion)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+		case errors.Is(err, repository.ErrVersionMismatch):
+			// Another write committed since If-Match was checked
+			http.Error(w, "User was changed concurrently, retry with its new version", http.StatusPreconditionFailed)
+		case errors.Is(err, repository.ErrRequired):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			serverError(w, r, err)
+		}
 		return
 	}
+	s.publish(entry)
 
-	// Reload user to get updated data
-	database.DB.First(&user, id)
+	if preferences(r)["return"] == returnDiff {
+		changes := entry.Diff
+		if changes == nil {
+			changes = patch.Changes{}
+		}
+		setETag(w, entry.Version)
+		w.Header().Set("Preference-Applied", "return="+returnDiff)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DiffResponse{ID: user.ID, Diff: changes})
+		return
+	}
+	s.writeUser(w, r, http.StatusOK, user, entry.Version)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+// DiffResponse is returned by PATCH for Prefer: return=diff and lists only the
+// fields whose values actually changed
+type DiffResponse struct {
+	ID   uint          `json:"id"`
+	Diff patch.Changes `json:"diff"`
 }
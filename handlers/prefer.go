@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang-http-patch/models"
+)
+
+// Values of the Prefer return= preference
+const (
+	returnMinimal        = "minimal"
+	returnRepresentation = "representation" // default
+	returnDiff           = "diff"           // PATCH only
+)
+
+// preferences parses the Prefer request header (RFC 7240) into preference
+// names and values, e.g. "return=minimal, dry-run" becomes
+// {"return": "minimal", "dry-run": ""}. Parameters after ";" are ignored.
+func preferences(r *http.Request) map[string]string {
+	prefs := make(map[string]string)
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			pref, _, _ = strings.Cut(pref, ";")
+			name, value, _ := strings.Cut(pref, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			prefs[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return prefs
+}
+
+// dryRun reports whether the request asks for a preview via ?dry_run=true or
+// Prefer: dry-run
+func dryRun(r *http.Request) (bool, error) {
+	if _, ok := preferences(r)["dry-run"]; ok {
+		return true, nil
+	}
+	value := r.URL.Query().Get("dry_run")
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// writeUser writes the user with the given status, honouring Prefer: return=.
+// With return=minimal only the status is sent, with 200 turned into 204. The
+// ETag header carries version, the version of the user as written.
+func (s *Server) writeUser(w http.ResponseWriter, r *http.Request, status int, user models.User, version uint) {
+	setETag(w, version)
+
+	switch preferences(r)["return"] {
+	case returnMinimal:
+		w.Header().Set("Preference-Applied", "return="+returnMinimal)
+		if status == http.StatusOK {
+			status = http.StatusNoContent
+		}
+		w.WriteHeader(status)
+		return
+	case returnRepresentation:
+		w.Header().Set("Preference-Applied", "return="+returnRepresentation)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(user)
+}
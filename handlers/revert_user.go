@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+	"golang-http-patch/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// RevertUserDTO selects the history version to restore
+type RevertUserDTO struct {
+	Version uint `json:"version" validate:"required,gte=1"`
+}
+
+// RevertUser handles POST /users/{id}/revert - Restore a user to the state
+// right after the given history version. The difference to the current state
+// is turned into an inverse patch and applied like a regular PATCH.
+func (s *Server) RevertUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var dto RevertUserDTO
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.validate(w, dto) {
+		return
+	}
+
+	user, version, err := s.Users.GetVersion(r.Context(), uint(id))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	// Versions are numbered from 1 without gaps
+	if dto.Version > version {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	target, err := s.userAt(r.Context(), id, func(entry models.UserHistory) bool {
+		return entry.Version > dto.Version
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "User did not exist at this version", http.StatusConflict)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	inverse, err := patchFromChanges(patch.Diff(user, target))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// Nothing differs from the requested version
+	if len(inverse.Updates()) == 0 {
+		s.writeUser(w, r, http.StatusOK, user, version)
+		return
+	}
+	// The inverse patch is only right for the version it was computed from
+	s.applyPatch(w, r, user, inverse, models.OperationRevert, &version)
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang-http-patch/events"
+	"golang-http-patch/idempotency"
+	"golang-http-patch/metrics"
+	"golang-http-patch/repository"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// DefaultHeartbeat is how often idle event streams and WebSockets are pinged
+// so that proxies and clients keep the connection open
+const DefaultHeartbeat = 15 * time.Second
+
+// Deps are what a Server is built from. DB and Validate are required, the
+// rest have defaults.
+type Deps struct {
+	DB              *gorm.DB
+	Validate        *validator.Validate       // see validation.New
+	Users           repository.UserRepository // defaults to a GORM repository on DB
+	Logger          *slog.Logger              // defaults to slog.Default
+	Events          *events.Broker            // defaults to a new broker
+	Metrics         *metrics.Metrics          // defaults to new metrics, without database instrumentation
+	Heartbeat       time.Duration             // defaults to DefaultHeartbeat
+	IdempotencyTTL  time.Duration             // defaults to idempotency.DefaultTTL
+	MaxBodyBytes    int64                     // request body limit, none by default
+	RequestTimeout  time.Duration             // deadline of each request, none by default
+	ReadinessChecks map[string]Check          // checked by GET /readyz besides the database, none by default
+}
+
+// Server holds everything the handlers need. The handlers are its methods,
+// so several servers with their own stores can run in one process.
+type Server struct {
+	DB              *gorm.DB
+	Validate        *validator.Validate
+	Users           repository.UserRepository
+	Logger          *slog.Logger
+	Events          *events.Broker
+	Metrics         *metrics.Metrics
+	Heartbeat       time.Duration
+	IdempotencyTTL  time.Duration
+	MaxBodyBytes    int64
+	RequestTimeout  time.Duration
+	ReadinessChecks map[string]Check
+
+	shuttingDown atomic.Bool   // set by BeginShutdown
+	draining     chan struct{} // closed by Drain
+	drainOnce    sync.Once
+	socketsMu    sync.Mutex     // guards sockets.Add against Drain
+	sockets      sync.WaitGroup // running WebSocket handlers
+}
+
+// NewServer returns a Server for deps, filling in defaults
+func NewServer(deps Deps) *Server {
+	s := &Server{
+		DB:              deps.DB,
+		Validate:        deps.Validate,
+		Users:           deps.Users,
+		Logger:          deps.Logger,
+		Events:          deps.Events,
+		Metrics:         deps.Metrics,
+		Heartbeat:       deps.Heartbeat,
+		IdempotencyTTL:  deps.IdempotencyTTL,
+		MaxBodyBytes:    deps.MaxBodyBytes,
+		RequestTimeout:  deps.RequestTimeout,
+		ReadinessChecks: deps.ReadinessChecks,
+		draining:        make(chan struct{}),
+	}
+	if s.Users == nil {
+		s.Users = repository.NewGORM(s.DB)
+	}
+	if s.Logger == nil {
+		s.Logger = slog.Default()
+	}
+	if s.Events == nil {
+		s.Events = events.NewBroker()
+	}
+	if s.Metrics == nil {
+		s.Metrics = metrics.New()
+	}
+	if s.Heartbeat <= 0 {
+		s.Heartbeat = DefaultHeartbeat
+	}
+	if s.IdempotencyTTL <= 0 {
+		s.IdempotencyTTL = idempotency.DefaultTTL
+	}
+	return s
+}
+
+// BeginShutdown makes GET /readyz fail from now on, so that the orchestrator
+// stops sending traffic before the server stops accepting it. Drain calls it
+// too.
+func (s *Server) BeginShutdown() {
+	s.shuttingDown.Store(true)
+}
+
+// ShuttingDown reports whether BeginShutdown has been called
+func (s *Server) ShuttingDown() bool {
+	return s.shuttingDown.Load()
+}
+
+// Drain ends all event streams and WebSockets, which would otherwise hold
+// up a graceful shutdown until its deadline, and waits for the WebSocket
+// handlers to return or ctx to be done. http.Server.Shutdown waits for the
+// event streams itself, but no longer tracks upgraded connections.
+func (s *Server) Drain(ctx context.Context) error {
+	// Under the lock, so that trackSocket has either added a socket before
+	// Wait or refuses it
+	s.socketsMu.Lock()
+	s.BeginShutdown()
+	s.drainOnce.Do(func() { close(s.draining) })
+	s.socketsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sockets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackSocket registers a WebSocket handler for Drain to wait for, unless
+// the server is shutting down. The caller must call sockets.Done if it
+// returns true.
+func (s *Server) trackSocket() bool {
+	s.socketsMu.Lock()
+	defer s.socketsMu.Unlock()
+	if s.ShuttingDown() {
+		return false
+	}
+	s.sockets.Add(1)
+	return true
+}
+
+// NewRouter returns the router serving the whole API for deps
+func NewRouter(deps Deps) *mux.Router {
+	return NewServer(deps).Router()
+}
+
+// Router returns a router with all routes of the server
+func (s *Server) Router() *mux.Router {
+	// Retried POST and PATCH requests are deduplicated by Idempotency-Key
+	idem := idempotency.Middleware(s.DB, s.IdempotencyTTL, s.Logger)
+
+	r := mux.NewRouter()
+	r.Use(s.accessLog, s.recoverPanics, s.limitBody, s.withTimeout)
+	// Unmatched requests skip the middleware, so they are logged explicitly
+	r.NotFoundHandler = s.accessLog(http.HandlerFunc(http.NotFound))
+	r.MethodNotAllowedHandler = s.accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	r.HandleFunc("/users", s.GetUsers).Methods("GET")
+	r.HandleFunc("/users/events", s.StreamUserEvents).Methods("GET").Name(routeUserEvents) // before /users/{id}
+	r.HandleFunc("/users/{id}", s.GetUser).Methods("GET")
+	r.Handle("/users", idem(http.HandlerFunc(s.CreateUser))).Methods("POST")
+	r.HandleFunc("/users/{id}", s.UpdateUser).Methods("PUT")
+	r.Handle("/users/{id}", idem(http.HandlerFunc(s.PatchUser))).Methods("PATCH")
+	r.HandleFunc("/users/{id}", s.DeleteUser).Methods("DELETE")
+	r.HandleFunc("/users/{id}/history", s.GetUserHistory).Methods("GET")
+	r.HandleFunc("/users/{id}/revert", s.RevertUser).Methods("POST")
+	r.HandleFunc("/users/{id}/ws", s.WatchUser).Methods("GET").Name(routeWatchUser)
+	r.HandleFunc("/webhooks", s.GetWebhooks).Methods("GET")
+	r.HandleFunc("/webhooks", s.CreateWebhook).Methods("POST")
+	r.HandleFunc("/webhooks/{id}", s.DeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/webhooks/{id}/deliveries", s.GetWebhookDeliveries).Methods("GET")
+	r.HandleFunc("/metrics", s.GetMetrics).Methods("GET")
+	r.HandleFunc("/healthz", s.GetHealth).Methods("GET")
+	r.HandleFunc("/readyz", s.GetReadiness).Methods("GET")
+	return r
+}
@@ -2,19 +2,22 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
-	"golang-http-patch/database"
 	"golang-http-patch/models"
+	"golang-http-patch/repository"
 	"golang-http-patch/validation"
 
 	"github.com/gorilla/mux"
-	"gorm.io/gorm/clause"
 )
 
-// UpdateUser handles PUT /users/{id} - Update a user (full update)
-func UpdateUser(w http.ResponseWriter, r *http.Request) {
+// UpdateUser handles PUT /users/{id} - Update a user (full update), or create
+// it at the given ID when it does not exist, in which case the body must
+// include an email
+func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseUint(vars["id"], 10, 32)
 	if err != nil {
@@ -28,34 +31,79 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !validation.ValidateStruct(w, dto) {
+	if !s.validate(w, dto) {
 		return
 	}
 
-	var updatedUser models.User
-	result := database.DB.Model(&updatedUser).
-		Clauses(clause.Returning{}).
-		Where("id = ?", id).
-		Updates(map[string]interface{}{
-			"name":   dto.Name,
-			"age":    dto.Age,
-			"phone":  dto.Phone,
-			"active": dto.Active,
-			"bio":    dto.Bio,
-			"role":   dto.Role,
-			"score":  dto.Score,
-			// Email is immutable and cannot be updated
-		})
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	preview, err := dryRun(r)
+	if err != nil {
+		http.Error(w, "Invalid dry_run value", http.StatusBadRequest)
 		return
 	}
 
-	if result.RowsAffected == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+	// If-None-Match: * only allows creating a user that does not exist yet
+	createOnly := r.Header.Get("If-None-Match") == "*"
+
+	user := models.User{
+		ID:     uint(id),
+		Name:   dto.Name,
+		Email:  dto.Email,
+		Age:    dto.Age,
+		Phone:  dto.Phone,
+		Active: dto.Active,
+		Bio:    dto.Bio,
+		Role:   dto.Role,
+		Score:  dto.Score,
+	}
+
+	status := http.StatusOK
+	var entry models.UserHistory
+	_, err = s.Users.Get(r.Context(), user.ID)
+	switch {
+	case err == nil && createOnly:
+		err = repository.ErrExists
+	case err == nil && preview:
+		// Email is immutable and only used when the user is created
+		s.previewUpdate(w, r, id, dto.Patch())
 		return
+	case err == nil:
+		entry, err = s.Users.Replace(r.Context(), &user, actor(r))
+	case errors.Is(err, repository.ErrNotFound) && id != 0:
+		// No user with this ID: create it at the given ID, which needs the
+		// email that Replace ignores
+		if dto.Email == "" {
+			s.Metrics.ValidationFailures.Inc("Email", "required")
+			validation.WriteFieldErrors(w, []map[string]string{{
+				"field":   "Email",
+				"tag":     "required",
+				"message": "Email is required to create the user",
+			}})
+			return
+		}
+		if preview {
+			s.writePreview(w, r, models.User{}, user)
+			return
+		}
+		status = http.StatusCreated
+		entry, err = s.Users.Create(r.Context(), &user, actor(r))
 	}
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrExists):
+			http.Error(w, "User already exists", http.StatusPreconditionFailed)
+		case errors.Is(err, repository.ErrEmailTaken):
+			http.Error(w, "Email already in use", http.StatusConflict)
+		case errors.Is(err, repository.ErrNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+		default:
+			serverError(w, r, err)
+		}
+		return
+	}
+	s.publish(entry)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedUser)
+	if status == http.StatusCreated {
+		w.Header().Set("Location", fmt.Sprintf("/users/%d", user.ID))
+	}
+	s.writeUser(w, r, status, user, entry.Version)
 }
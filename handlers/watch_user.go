@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+	"golang-http-patch/repository"
+	"golang-http-patch/validation"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket message types
+const (
+	MessageSnapshot = "snapshot" // server: the user when the socket opened
+	MessageDiff     = "diff"     // server: a committed change to the user
+	MessageAck      = "ack"      // server: a patch message was applied
+	MessageError    = "error"    // server: a patch message was rejected
+	MessagePatch    = "patch"    // client: a PatchUserDTO to apply
+)
+
+// SocketMessage is sent in both directions on GET /users/{id}/ws. Ref is
+// chosen by the client on patch messages and echoed on the ack or error.
+type SocketMessage struct {
+	Type      string              `json:"type"`
+	Ref       string              `json:"ref,omitempty"`
+	Version   uint                `json:"version,omitempty"`
+	User      *models.User        `json:"user,omitempty"`
+	Operation string              `json:"operation,omitempty"`
+	Actor     string              `json:"actor,omitempty"`
+	Diff      patch.Changes       `json:"diff,omitempty"`
+	Patch     json.RawMessage     `json:"patch,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	Errors    []map[string]string `json:"errors,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{}
+
+// WatchUser handles GET /users/{id}/ws - Watch a user over a WebSocket.
+//
+// The server first sends a snapshot of the user and its version, then a diff
+// message for every change committed after it, whichever API made it. The
+// client may send patch messages, which go through the same validation and
+// write path as PATCH /users/{id}. The socket is closed after the user is
+// deleted.
+func (s *Server) WatchUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe before taking the snapshot so that no change is missed
+	live, cancel := s.Events.Subscribe()
+	defer cancel()
+
+	user, version, err := s.Users.GetVersion(r.Context(), uint(id))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	// Drain may already be waiting for the open sockets
+	if !s.trackSocket() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.sockets.Done()
+
+	// The connection outlives the server's read and write timeouts; pings
+	// detect dead peers instead
+	clearDeadlines(w)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has already responded
+	}
+	defer conn.Close()
+
+	// Only this goroutine writes; incoming messages are handed over to it
+	incoming := make(chan SocketMessage)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(incoming)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg SocketMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				msg = SocketMessage{Type: MessageError, Error: "Invalid JSON"}
+			}
+			select {
+			case incoming <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if conn.WriteJSON(SocketMessage{Type: MessageSnapshot, Version: version, User: &user}) != nil {
+		return
+	}
+
+	ping := time.NewTicker(s.Heartbeat)
+	defer ping.Stop()
+
+	for {
+		var reply SocketMessage
+		select {
+		case msg, ok := <-incoming:
+			if !ok {
+				return
+			}
+			reply = s.handleSocketMessage(r, id, msg)
+		case entry, ok := <-live:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Too far behind"))
+				return
+			}
+			// Changes up to the snapshot are part of it. Later ones are all
+			// sent, as concurrent writes may publish out of version order.
+			if uint64(entry.UserID) != id || entry.Version <= version {
+				continue
+			}
+			reply = SocketMessage{
+				Type:      MessageDiff,
+				Version:   entry.Version,
+				Operation: entry.Operation,
+				Actor:     entry.Actor,
+				Diff:      entry.Diff,
+			}
+		case <-s.draining:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"))
+			return
+		case <-ping.C:
+			deadline := time.Now().Add(s.Heartbeat)
+			if conn.WriteControl(websocket.PingMessage, nil, deadline) != nil {
+				return
+			}
+			continue
+		}
+
+		if conn.WriteJSON(reply) != nil {
+			return
+		}
+		if reply.Operation == models.OperationDelete {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "User deleted"))
+			return
+		}
+	}
+}
+
+// handleSocketMessage applies a patch message to the user and returns the
+// ack or error to send back
+func (s *Server) handleSocketMessage(r *http.Request, id uint64, msg SocketMessage) SocketMessage {
+	fail := func(message string) SocketMessage {
+		return SocketMessage{Type: MessageError, Ref: msg.Ref, Error: message}
+	}
+
+	switch {
+	case msg.Type == MessageError:
+		return msg
+	case msg.Type != MessagePatch:
+		return fail("Unknown message type")
+	}
+
+	var dto models.PatchUserDTO
+	if len(msg.Patch) == 0 || json.Unmarshal(msg.Patch, &dto) != nil {
+		return fail("Invalid patch")
+	}
+	s.Metrics.ObservePatch(dto)
+	if err := s.Validate.Struct(dto); err != nil {
+		s.countValidationErrors(err)
+		reply := fail("Validation failed")
+		reply.Errors = validation.FieldErrors(err)
+		return reply
+	}
+	if len(dto.Updates()) == 0 {
+		return fail("No fields to update")
+	}
+
+	_, entry, err := s.Users.Patch(r.Context(), uint(id), dto, models.OperationPatch, actor(r), nil)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return fail("User not found")
+		}
+		return fail(models.UserRedaction.Text(err.Error()))
+	}
+	s.publish(entry)
+	return SocketMessage{Type: MessageAck, Ref: msg.Ref, Version: entry.Version}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"golang-http-patch/models"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// CreateWebhook handles POST /webhooks - Register a webhook
+func (s *Server) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var dto models.CreateWebhookDTO
+	if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Validate DTO
+	if !s.validate(w, dto) {
+		return
+	}
+
+	hook := models.Webhook{
+		URL:        dto.URL,
+		Secret:     dto.Secret,
+		Operations: dto.Operations,
+		Fields:     dto.Fields,
+	}
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+
+	if err := s.db(r.Context()).Create(&hook).Error; err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// The secret is only ever returned here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// GetWebhooks handles GET /webhooks - List registered webhooks
+func (s *Server) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks := []models.Webhook{}
+	if err := s.db(r.Context()).Omit("secret").Order("id").Find(&hooks).Error; err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// DeleteWebhook handles DELETE /webhooks/{id} - Unregister a webhook along
+// with its pending deliveries
+func (s *Server) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.db(r.Context()).Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&models.Webhook{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("webhook_id = ?", id).Delete(&models.WebhookDelivery{}).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries handles GET /webhooks/{id}/deliveries - List the
+// deliveries of a webhook, newest first, optionally filtered by ?status=
+// (pending, delivered or dead)
+func (s *Server) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db(r.Context()).Select("id").First(&models.Webhook{}, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	query := s.db(r.Context()).Where("webhook_id = ?", id)
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+	case models.DeliveryPending, models.DeliveryDelivered, models.DeliveryDead:
+		query = query.Where("status = ?", status)
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	if err := query.Order("id DESC").Limit(maxPageSize).Find(&deliveries).Error; err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// webhookID parses the webhook ID from the URL, writing 400 when invalid
+func webhookID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
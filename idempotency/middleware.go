@@ -0,0 +1,210 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang-http-patch/logging"
+	"golang-http-patch/models"
+
+	"gorm.io/gorm"
+)
+
+// HeaderName is the request header carrying the client-chosen key
+const HeaderName = "Idempotency-Key"
+
+// ReplayedHeader is set on responses that were replayed from a stored result
+const ReplayedHeader = "Idempotent-Replayed"
+
+// DefaultTTL is how long a stored response can be replayed
+const DefaultTTL = 24 * time.Hour
+
+// statusClientClosedRequest is recorded for requests the client abandoned,
+// which may not have been applied and must run again when retried
+const statusClientClosedRequest = 499
+
+// maxKeyLength matches the size of the key column
+const maxKeyLength = 255
+
+// Middleware makes requests that carry an Idempotency-Key header safe to retry.
+//
+// - first request => handled normally, response stored for ttl
+// - retry with the same request => stored response replayed
+// - retry with a different request => 422 Unprocessable Entity
+// - retry while the first is still running => 409 Conflict
+//
+// Requests without the header are passed through untouched. Responses with a
+// 5xx or 499 status are not stored so that the client can retry them, and
+// neither are responses the handler passed to Discard. Keys are stored in db;
+// failures to store them are reported to logger.
+func Middleware(db *gorm.DB, ttl time.Duration, logger *slog.Logger) func(http.Handler) http.Handler {
+	// inFlight tracks keys whose first request is still being processed
+	var inFlight sync.Map
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(HeaderName)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxKeyLength {
+				http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := Fingerprint(r, body)
+
+			if _, busy := inFlight.LoadOrStore(key, struct{}{}); busy {
+				http.Error(w, "A request with this Idempotency-Key is already in progress", http.StatusConflict)
+				return
+			}
+			defer inFlight.Delete(key)
+
+			var stored models.IdempotencyKey
+			result := db.WithContext(r.Context()).First(&stored, "key = ?", key)
+			switch {
+			case result.Error == nil && time.Now().After(stored.ExpiresAt):
+				// Expired keys behave as if they had never been used
+				db.WithContext(r.Context()).Delete(&stored)
+			case result.Error == nil:
+				if stored.Fingerprint != fingerprint {
+					http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+					return
+				}
+				replay(w, stored)
+				return
+			case !errors.Is(result.Error, gorm.ErrRecordNotFound):
+				http.Error(w, models.UserRedaction.Text(result.Error.Error()), http.StatusInternalServerError)
+				return
+			}
+
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+			discard := new(bool)
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), discardKey{}, discard)))
+
+			if *discard || rec.status >= http.StatusInternalServerError || rec.status == statusClientClosedRequest {
+				return
+			}
+			// The response has been sent, so store it even if the client has
+			// gone away in the meantime; otherwise a retry would run again
+			ctx := context.WithoutCancel(r.Context())
+			if err := save(db.WithContext(ctx), key, fingerprint, rec, ttl); err != nil {
+				logger.ErrorContext(r.Context(), "Failed to store idempotency key", "error", err)
+			}
+		})
+	}
+}
+
+// Fingerprint identifies a request by its method, path, query, Prefer header
+// and body. The query and Prefer header can change what a request does, e.g.
+// ?dry_run=true or ?update_mask=.
+func Fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n"))
+	h.Write([]byte(strings.Join(r.Header.Values("Prefer"), ", ") + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// discardKey holds the flag set by Discard in the request context
+type discardKey struct{}
+
+// Discard keeps the response to the request with ctx from being stored, for
+// responses such as dry runs that did not change anything. Retries then run
+// again. It does nothing for requests without an Idempotency-Key.
+func Discard(ctx context.Context) {
+	if discard, ok := ctx.Value(discardKey{}).(*bool); ok {
+		*discard = true
+	}
+}
+
+// PurgeExpired deletes all keys whose TTL has elapsed
+func PurgeExpired(db *gorm.DB) (int64, error) {
+	result := db.Where("expires_at < ?", time.Now()).Delete(&models.IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
+
+// perRequestHeaders belong to one request and are never stored or replayed,
+// so that a retry keeps its own request ID
+var perRequestHeaders = []string{logging.RequestIDHeader}
+
+func save(db *gorm.DB, key, fingerprint string, rec *recorder, ttl time.Duration) error {
+	stored := rec.Header().Clone()
+	for _, name := range perRequestHeaders {
+		stored.Del(name)
+	}
+	header, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := PurgeExpired(db); err != nil {
+		return err
+	}
+	return db.Create(&models.IdempotencyKey{
+		Key:         key,
+		Fingerprint: fingerprint,
+		StatusCode:  rec.status,
+		Header:      string(header),
+		Body:        rec.body.Bytes(),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}).Error
+}
+
+func replay(w http.ResponseWriter, stored models.IdempotencyKey) {
+	var header http.Header
+	if err := json.Unmarshal([]byte(stored.Header), &header); err == nil {
+		for _, name := range perRequestHeaders {
+			header.Del(name)
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+// recorder passes the response through while keeping a copy of it
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
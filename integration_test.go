@@ -1,20 +1,42 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"golang-http-patch/config"
 	"golang-http-patch/database"
+	"golang-http-patch/events"
 	"golang-http-patch/handlers"
+	"golang-http-patch/logging"
+	"golang-http-patch/metrics"
 	"golang-http-patch/models"
+	"golang-http-patch/patch"
+	"golang-http-patch/problem"
+	"golang-http-patch/repository"
 	"golang-http-patch/validation"
+	"golang-http-patch/webhooks"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -26,6 +48,14 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
 
+	// Every connection to :memory: opens a separate database, so tests that
+	// serve concurrent requests must share a single one
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("Failed to get test database handle: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
 	err = models.AutoMigrate(db)
 	if err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
@@ -34,27 +64,18 @@ func setupTestDB(t *testing.T) *gorm.DB {
 	return db
 }
 
-// setupTestRouter creates a router with test database
-func setupTestRouter(t *testing.T, db *gorm.DB) *mux.Router {
-	// Set the global DB for handlers to use
-	database.DB = db
-
-	r := mux.NewRouter()
-	r.HandleFunc("/users", handlers.GetUsers).Methods("GET")
-	r.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
-	r.HandleFunc("/users", handlers.CreateUser).Methods("POST")
-	r.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
-	r.HandleFunc("/users/{id}", handlers.PatchUser).Methods("PATCH")
-	return r
+// testDeps returns the dependencies of a server using the test database
+func testDeps(db *gorm.DB) handlers.Deps {
+	return handlers.Deps{
+		DB:       db,
+		Validate: validation.New(),
+		Logger:   slog.New(slog.DiscardHandler),
+	}
 }
 
-func TestMain(m *testing.M) {
-	// Initialize validator once
-	validation.InitValidator()
-
-	// Run tests
-	code := m.Run()
-	os.Exit(code)
+// setupTestRouter creates a router with test database
+func setupTestRouter(t *testing.T, db *gorm.DB) *mux.Router {
+	return handlers.NewRouter(testDeps(db))
 }
 
 func TestCreateUser(t *testing.T) {
@@ -746,6 +767,2266 @@ func TestPatchUser_ValidationRules(t *testing.T) {
 	}
 }
 
+func TestCreateUser_IdempotencyKey(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	post := func(key string, dto models.CreateUserDTO) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(dto)
+		req := httptest.NewRequest("POST", "/users", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	createReq := models.CreateUserDTO{Name: "Retry User", Email: "retry@example.com", Age: 30}
+
+	first := post("key-1", createReq)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusCreated, first.Code, first.Body.String())
+	}
+
+	// Retry with the same key and body replays the original response
+	retry := post("key-1", createReq)
+	if retry.Code != http.StatusCreated {
+		t.Errorf("Expected replayed status %d, got %d. Body: %s", http.StatusCreated, retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected Idempotent-Replayed header on retry")
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected replayed body %s, got %s", first.Body.String(), retry.Body.String())
+	}
+	if first.Header().Get(logging.RequestIDHeader) == retry.Header().Get(logging.RequestIDHeader) {
+		t.Error("Expected the retry to keep its own request ID")
+	}
+
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 user after retry, got %d", count)
+	}
+
+	// Same key with a different body is rejected
+	otherReq := createReq
+	otherReq.Name = "Someone Else"
+	if w := post("key-1", otherReq); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+
+	// Once the key expires it can be used for a new request
+	db.Model(&models.IdempotencyKey{}).Where("key = ?", "key-1").Update("expires_at", time.Now().Add(-time.Minute))
+	otherReq.Email = "other@example.com"
+	if w := post("key-1", otherReq); w.Code != http.StatusCreated {
+		t.Errorf("Expected status %d after expiry, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+}
+
+func TestPatchUser_IdempotencyKey(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	user := models.User{Name: "Patch Retry", Email: "patch-retry@example.com", Age: 30, Role: "user"}
+	db.Create(&user)
+
+	patch := func(id uint, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", fmt.Sprintf("/users/%d", id), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "patch-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := patch(user.ID, `{"age": 31}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Change the row behind the key's back; the retry must not re-apply the patch
+	db.Model(&user).Update("age", 40)
+	w := patch(user.ID, `{"age": 31}`)
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected Idempotent-Replayed header on retry")
+	}
+	var stored models.User
+	db.First(&stored, user.ID)
+	if stored.Age != 40 {
+		t.Errorf("Retry should not re-apply the patch, expected age 40, got %d", stored.Age)
+	}
+
+	// The same key on another resource is a different request
+	if w := patch(user.ID+1, `{"age": 31}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+}
+
+func TestPatchUser_IdempotencyKeyDryRun(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	user := models.User{Name: "Dry Retry", Email: "dry-retry@example.com", Age: 30, Role: "user"}
+	db.Create(&user)
+
+	patch := func(key, query, prefer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", fmt.Sprintf("/users/%d%s", user.ID, query), bytes.NewBufferString(`{"age": 6}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		if prefer != "" {
+			req.Header.Set("Prefer", prefer)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	age := func() int {
+		var stored models.User
+		db.First(&stored, user.ID)
+		return stored.Age
+	}
+
+	// A dry run is not stored, so the real request with the same key runs
+	for _, preview := range []struct{ query, prefer string }{{"?dry_run=true", ""}, {"", "dry-run"}} {
+		key := "dry" + preview.query + preview.prefer
+		if w := patch(key, preview.query, preview.prefer); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"dry_run":true`) {
+			t.Fatalf("Expected a dry run, got %d. Body: %s", w.Code, w.Body.String())
+		}
+		w := patch(key, "", "")
+		if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" || age() != 6 {
+			t.Errorf("Expected the patch to be applied after the dry run, got %d (age %d). Body: %s", w.Code, age(), w.Body.String())
+		}
+		db.Model(&user).Update("age", 30)
+	}
+
+	// The query and Prefer header are part of the request
+	if w := patch("masked", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := patch("masked", "?update_mask=age", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d for another query, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if w := patch("masked", "", "return=minimal"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d for another Prefer header, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+}
+
+func TestPatchUser_DryRun(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	user := models.User{
+		Name:   "Preview User",
+		Email:  "preview@example.com",
+		Age:    30,
+		Phone:  stringPtr("1234567890"),
+		Active: true,
+		Role:   "user",
+	}
+	db.Create(&user)
+
+	body := `{"name": "Previewed Name", "phone": null, "age": 30}`
+	req := httptest.NewRequest("PATCH", fmt.Sprintf("/users/%d?dry_run=true", user.ID), bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var preview struct {
+		DryRun bool                              `json:"dry_run"`
+		User   models.User                       `json:"user"`
+		Diff   map[string]map[string]interface{} `json:"diff"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if !preview.DryRun {
+		t.Error("Expected dry_run to be true")
+	}
+	if preview.User.Name != "Previewed Name" || preview.User.Phone != nil {
+		t.Errorf("Expected previewed user with new name and no phone, got %+v", preview.User)
+	}
+	if len(preview.Diff) != 2 {
+		t.Errorf("Expected diff for name and phone only, got %v", preview.Diff)
+	}
+	if change := preview.Diff["name"]; change["from"] != "Preview User" || change["to"] != "Previewed Name" {
+		t.Errorf("Unexpected name diff: %v", change)
+	}
+	if change := preview.Diff["phone"]; change["from"] != "1234567890" || change["to"] != nil {
+		t.Errorf("Unexpected phone diff: %v", change)
+	}
+
+	// Nothing was written
+	var stored models.User
+	db.First(&stored, user.ID)
+	if stored.Name != user.Name || stored.Phone == nil {
+		t.Errorf("Dry run should not modify the user, got %+v", stored)
+	}
+}
+
+func TestUpdateUser_DryRunPrefer(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	user := models.User{Name: "Put Preview", Email: "put-preview@example.com", Age: 30, Role: "user", Score: 10}
+	db.Create(&user)
+
+	updateReq := models.UpdateUserDTO{Name: "Put Preview", Age: 31, Role: "admin", Score: 10}
+	body, _ := json.Marshal(updateReq)
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/users/%d", user.ID), bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "dry-run")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Header().Get("Preference-Applied") != "dry-run" {
+		t.Errorf("Expected Preference-Applied: dry-run, got %q", w.Header().Get("Preference-Applied"))
+	}
+
+	var preview struct {
+		User models.User                       `json:"user"`
+		Diff map[string]map[string]interface{} `json:"diff"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if preview.User.Age != 31 || preview.User.Role != "admin" {
+		t.Errorf("Expected previewed age 31 and role admin, got %+v", preview.User)
+	}
+	// active goes from true (default) to false because PUT replaces every field
+	for _, field := range []string{"age", "role", "active"} {
+		if _, ok := preview.Diff[field]; !ok {
+			t.Errorf("Expected %s in diff, got %v", field, preview.Diff)
+		}
+	}
+
+	var stored models.User
+	db.First(&stored, user.ID)
+	if stored.Age != 30 || stored.Role != "user" {
+		t.Errorf("Dry run should not modify the user, got %+v", stored)
+	}
+
+	// Previewing a missing user previews its creation, which needs an email
+	req = httptest.NewRequest("PUT", "/users/99999?dry_run=1", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Email is required") {
+		t.Errorf("Expected status %d for a missing email, got %d. Body: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+
+	updateReq.Email = "put-created@example.com"
+	body, _ = json.Marshal(updateReq)
+	req = httptest.NewRequest("PUT", "/users/99999?dry_run=1", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	preview.Diff = nil
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if preview.User.ID != 99999 || preview.User.Email != "put-created@example.com" {
+		t.Errorf("Expected the would-be user 99999, got %+v", preview.User)
+	}
+	if email := preview.Diff["email"]; email == nil || email["from"] != "" || email["to"] != "put-created@example.com" {
+		t.Errorf("Expected the email to be created in diff, got %v", preview.Diff)
+	}
+	if err := db.First(&models.User{}, 99999).Error; err == nil {
+		t.Error("Dry run should not create the user")
+	}
+}
+
+func TestPatchUser_ReturnDiff(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	user := models.User{Name: "Diff User", Email: "diff@example.com", Age: 30, Bio: "Bio", Role: "user"}
+	db.Create(&user)
+
+	var writes int
+	db.Callback().Update().Before("gorm:update").Register("test:count_writes", func(*gorm.DB) { writes++ })
+
+	patchDiff := func(body string) (*httptest.ResponseRecorder, map[string]map[string]interface{}) {
+		req := httptest.NewRequest("PATCH", fmt.Sprintf("/users/%d", user.ID), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "return=diff")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var resp struct {
+			ID   uint                              `json:"id"`
+			Diff map[string]map[string]interface{} `json:"diff"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v. Body: %s", err, w.Body.String())
+		}
+		if resp.ID != user.ID {
+			t.Errorf("Expected id %d, got %d", user.ID, resp.ID)
+		}
+		return w, resp.Diff
+	}
+
+	// Sending a field with its current value is not a change
+	w, diff := patchDiff(`{"name": "Diff User", "age": 31}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Header().Get("Preference-Applied") != "return=diff" {
+		t.Errorf("Expected Preference-Applied: return=diff, got %q", w.Header().Get("Preference-Applied"))
+	}
+	if len(diff) != 1 || diff["age"]["from"] != float64(30) || diff["age"]["to"] != float64(31) {
+		t.Errorf("Expected only age to change from 30 to 31, got %v", diff)
+	}
+	if writes != 1 {
+		t.Errorf("Expected 1 write, got %d", writes)
+	}
+
+	// A patch that changes nothing skips the write entirely
+	w, diff = patchDiff(`{"name": "Diff User", "bio": "Bio"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if len(diff) != 0 {
+		t.Errorf("Expected empty diff, got %v", diff)
+	}
+	if writes != 1 {
+		t.Errorf("No-op patch should not write, got %d writes", writes)
+	}
+}
+
+func TestPreferReturnMinimal(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url string, body interface{}, prefer string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, url, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		if prefer != "" {
+			req.Header.Set("Prefer", prefer)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// POST: 201 with Location and no body
+	w := send("POST", "/users", models.CreateUserDTO{Name: "Minimal", Email: "minimal@example.com", Age: 20}, "return=minimal")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected empty body, got %s", w.Body.String())
+	}
+	if w.Header().Get("Preference-Applied") != "return=minimal" {
+		t.Errorf("Expected Preference-Applied: return=minimal, got %q", w.Header().Get("Preference-Applied"))
+	}
+	location := w.Header().Get("Location")
+
+	var created models.User
+	db.First(&created, "email = ?", "minimal@example.com")
+	if location != fmt.Sprintf("/users/%d", created.ID) {
+		t.Errorf("Expected Location /users/%d, got %q", created.ID, location)
+	}
+
+	// PUT: 204
+	w = send("PUT", location, models.UpdateUserDTO{Name: "Minimal Put", Age: 21, Role: "user", Score: 1}, "return=minimal")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Expected status %d with no body, got %d. Body: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	// PATCH: 204 without reloading the user
+	var queries int
+	db.Callback().Query().Before("gorm:query").Register("test:count_queries", func(*gorm.DB) { queries++ })
+	w = send("PATCH", location, map[string]interface{}{"age": 22}, "return=minimal")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Expected status %d with no body, got %d. Body: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	// One lookup by the handler and one inside the write transaction
+	if queries != 2 {
+		t.Errorf("Expected two lookup queries without reload, got %d", queries)
+	}
+
+	var stored models.User
+	db.First(&stored, created.ID)
+	if stored.Name != "Minimal Put" || stored.Age != 22 {
+		t.Errorf("Expected writes to be applied, got %+v", stored)
+	}
+
+	// return=representation is the default and is acknowledged when asked for
+	w = send("PATCH", location, map[string]interface{}{"age": 23}, "return=representation")
+	if w.Code != http.StatusOK || w.Header().Get("Preference-Applied") != "return=representation" {
+		t.Errorf("Expected 200 with Preference-Applied: return=representation, got %d %q", w.Code, w.Header().Get("Preference-Applied"))
+	}
+	var patched models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &patched); err != nil || patched.Age != 23 {
+		t.Errorf("Expected full user with age 23, got %s", w.Body.String())
+	}
+	if w = send("PATCH", location, map[string]interface{}{"age": 24}, ""); w.Header().Get("Preference-Applied") != "" {
+		t.Errorf("Expected no Preference-Applied header by default, got %q", w.Header().Get("Preference-Applied"))
+	}
+}
+
+func TestUpdateUser_Upsert(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	put := func(id uint, dto models.UpdateUserDTO, ifNoneMatch string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(dto)
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/users/%d", id), bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	dto := models.UpdateUserDTO{Name: "Synced User", Age: 40, Active: false, Role: "guest", Score: 12.5}
+
+	// Without an email a missing user cannot be created
+	if w := put(42, dto, ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Email is required to create the user") {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+
+	// With an email the user is created at the requested ID
+	dto.Email = "synced@example.com"
+	w := put(42, dto, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w.Header().Get("Location") != "/users/42" {
+		t.Errorf("Expected Location /users/42, got %q", w.Header().Get("Location"))
+	}
+	var created models.User
+	db.First(&created, 42)
+	if created.Email != dto.Email || created.Name != dto.Name || created.Active {
+		t.Errorf("Expected created user to match the request (active=false), got %+v", created)
+	}
+
+	// The second PUT updates and ignores the email
+	dto.Name = "Synced Again"
+	dto.Email = "changed@example.com"
+	if w := put(42, dto, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var updated models.User
+	db.First(&updated, 42)
+	if updated.Name != "Synced Again" || updated.Email != "synced@example.com" {
+		t.Errorf("Expected name updated and email unchanged, got %+v", updated)
+	}
+
+	// If-None-Match: * refuses to overwrite an existing user
+	if w := put(42, dto, "*"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusPreconditionFailed, w.Code, w.Body.String())
+	}
+	dto.Email = "create-only@example.com"
+	if w := put(43, dto, "*"); w.Code != http.StatusCreated {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	// An invalid email is rejected by validation
+	dto.Email = "not-an-email"
+	if w := put(44, dto, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestUserHistory(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url, body, actor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if actor != "" {
+			req.Header.Set("X-Actor", actor)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/users", `{"name": "History User", "email": "history@example.com", "age": 30}`, "alice")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	url := fmt.Sprintf("/users/%d", user.ID)
+
+	send("PUT", url, `{"name": "History User", "age": 31, "active": true, "role": "user", "score": 10}`, "bob")
+	send("PATCH", url, `{"bio": "Hello"}`, "")
+	send("PATCH", url, `{"bio": "Hello"}`, "carol") // no-op, not recorded
+	if w := send("DELETE", url, "", "dave"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	var entries []models.UserHistory
+	db.Order("version").Find(&entries, "user_id = ?", user.ID)
+	expected := []struct{ operation, actor string }{
+		{models.OperationCreate, "alice"},
+		{models.OperationUpdate, "bob"},
+		{models.OperationPatch, "anonymous"},
+		{models.OperationDelete, "dave"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d history entries, got %d: %+v", len(expected), len(entries), entries)
+	}
+	for i, e := range expected {
+		if entries[i].Version != uint(i+1) || entries[i].Operation != e.operation || entries[i].Actor != e.actor {
+			t.Errorf("Entry %d: expected version %d %s by %s, got %+v", i, i+1, e.operation, e.actor, entries[i])
+		}
+	}
+	if change, ok := entries[2].Diff["bio"]; !ok || change.From != "" || change.To != "Hello" {
+		t.Errorf("Expected patch diff of bio from \"\" to Hello, got %v", entries[2].Diff)
+	}
+	if _, ok := entries[1].Diff["age"]; !ok {
+		t.Errorf("Expected update diff to include age, got %v", entries[1].Diff)
+	}
+
+	// Paginated browsing, newest first
+	w = send("GET", url+"/history?page=2&page_size=3", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var page struct {
+		Items    []models.UserHistory `json:"items"`
+		Page     int                  `json:"page"`
+		PageSize int                  `json:"page_size"`
+		Total    int64                `json:"total"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if page.Total != 4 || page.Page != 2 || page.PageSize != 3 || len(page.Items) != 1 || page.Items[0].Version != 1 {
+		t.Errorf("Unexpected second page: %+v", page)
+	}
+
+	if w := send("GET", url+"/history?page_size=0", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid page_size, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := send("GET", "/users/99999/history", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown user, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := send("DELETE", url, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d deleting twice, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestGetUser_AsOf(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	getAsOf := func(url string, at time.Time) *httptest.ResponseRecorder {
+		return send("GET", url+"?as_of="+at.UTC().Format(time.RFC3339Nano), "")
+	}
+
+	beforeCreate := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	w := send("POST", "/users", `{"name": "Time Traveller", "email": "time@example.com", "age": 30, "phone": "1234567890"}`)
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	url := fmt.Sprintf("/users/%d", user.ID)
+
+	time.Sleep(5 * time.Millisecond)
+	afterCreate := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	send("PATCH", url, `{"name": "Time Traveller II", "phone": null}`)
+	time.Sleep(5 * time.Millisecond)
+	afterPatch := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	send("DELETE", url, "")
+
+	if w := getAsOf(url, beforeCreate); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d before creation, got %d. Body: %s", http.StatusNotFound, w.Code, w.Body.String())
+	}
+
+	w = getAsOf(url, afterCreate)
+	var original models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &original); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v. Body: %s", err, w.Body.String())
+	}
+	if original.Name != "Time Traveller" || original.Phone == nil || *original.Phone != "1234567890" || original.Email != "time@example.com" {
+		t.Errorf("Expected the user as created, got %+v", original)
+	}
+
+	w = getAsOf(url, afterPatch)
+	var patched models.User
+	json.Unmarshal(w.Body.Bytes(), &patched)
+	if patched.Name != "Time Traveller II" || patched.Phone != nil || patched.Age != 30 {
+		t.Errorf("Expected the patched user, got %+v", patched)
+	}
+
+	if w := getAsOf(url, time.Now()); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d after deletion, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := send("GET", url+"?as_of=yesterday", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid as_of, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRevertUser(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Actor", "reverter")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/users", `{"name": "Revert Me", "email": "revert@example.com", "age": 30, "phone": "1234567890", "bio": "v1"}`)
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	url := fmt.Sprintf("/users/%d", user.ID)
+
+	send("PATCH", url, `{"bio": "v2", "phone": null}`)                                                              // version 2
+	send("PUT", url, `{"name": "Replaced", "age": 45, "active": false, "role": "admin", "score": 50, "bio": "v3"}`) // version 3
+
+	w = send("POST", url+"/revert", `{"version": 1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var reverted models.User
+	json.Unmarshal(w.Body.Bytes(), &reverted)
+	if reverted.Name != "Revert Me" || reverted.Age != 30 || reverted.Bio != "v1" || reverted.Role != "user" ||
+		!reverted.Active || reverted.Score != 0 || reverted.Phone == nil || *reverted.Phone != "1234567890" {
+		t.Errorf("Expected user restored to version 1, got %+v", reverted)
+	}
+
+	var latest models.UserHistory
+	db.Order("version DESC").First(&latest, "user_id = ?", user.ID)
+	if latest.Version != 4 || latest.Operation != models.OperationRevert || latest.Actor != "reverter" {
+		t.Errorf("Expected revert recorded as version 4, got %+v", latest)
+	}
+
+	// Reverting to the current state changes nothing
+	if w := send("POST", url+"/revert", `{"version": 4}`); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var count int64
+	db.Model(&models.UserHistory{}).Where("user_id = ?", user.ID).Count(&count)
+	if count != 4 {
+		t.Errorf("Expected no new history entry, got %d entries", count)
+	}
+
+	if w := send("POST", url+"/revert", `{"version": 9}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown version, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := send("POST", url+"/revert", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without version, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// A failing history lookup is a server error, not a missing version
+	db.Migrator().DropTable(&models.UserHistory{})
+	if w := send("POST", url+"/revert", `{"version": 1}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d when the history cannot be read, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestPatchUser_IfMatchMerge(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/users", `{"name": "Merge User", "email": "merge@example.com", "age": 30, "bio": "v1"}`, "")
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	url := fmt.Sprintf("/users/%d", user.ID)
+
+	w = send("GET", url, "", "")
+	base := w.Header().Get("ETag")
+	if base != `"1"` {
+		t.Fatalf("Expected ETag \"1\", got %q", base)
+	}
+
+	// Another client changes the bio in the meantime
+	w = send("PATCH", url, `{"bio": "v2"}`, base)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected status %d with ETag \"2\", got %d %q", http.StatusOK, w.Code, w.Header().Get("ETag"))
+	}
+
+	// A patch of other fields based on version 1 is merged
+	w = send("PATCH", url, `{"age": 31, "role": "admin"}`, base)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var merged models.User
+	json.Unmarshal(w.Body.Bytes(), &merged)
+	if merged.Bio != "v2" || merged.Age != 31 || merged.Role != "admin" {
+		t.Errorf("Expected both changes to be kept, got %+v", merged)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"3"` {
+		t.Errorf("Expected ETag \"3\", got %q", etag)
+	}
+
+	// Making the same change as the newer version is not a conflict
+	if w := send("PATCH", url, `{"bio": "v2"}`, base); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// A different change to the same field is
+	w = send("PATCH", url, `{"bio": "mine", "name": "Renamed"}`, base)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	var conflict handlers.ConflictResponse
+	json.Unmarshal(w.Body.Bytes(), &conflict)
+	if conflict.CurrentVersion != 3 || len(conflict.Conflicts) != 1 || conflict.Conflicts[0].Field != "bio" ||
+		conflict.Conflicts[0].Base != "v1" || conflict.Conflicts[0].Current != "v2" || conflict.Conflicts[0].Requested != "mine" {
+		t.Errorf("Unexpected conflict response: %+v", conflict)
+	}
+
+	var current models.User
+	db.First(&current, user.ID)
+	if current.Name != "Merge User" {
+		t.Errorf("Expected conflicting patch not to be applied, got name %q", current.Name)
+	}
+
+	if w := send("PATCH", url, `{"bio": "mine"}`, `"3"`); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d for the current version, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := send("PATCH", url, `{"bio": "later"}`, `"9"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d for unknown version, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	if w := send("PATCH", url, `{"bio": "later"}`, "not-an-etag"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d for invalid If-Match, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+}
+
+// interferingUsers is a repository where another client's patch commits right
+// before every patch, after the handler has checked If-Match
+type interferingUsers struct {
+	repository.UserRepository
+}
+
+func (u interferingUsers) Patch(ctx context.Context, id uint, dto models.PatchUserDTO, operation, actor string, ifVersion *uint) (models.User, models.UserHistory, error) {
+	var other models.PatchUserDTO
+	json.Unmarshal([]byte(`{"bio": "theirs"}`), &other)
+	if _, _, err := u.UserRepository.Patch(ctx, id, other, models.OperationPatch, "other", nil); err != nil {
+		return models.User{}, models.UserHistory{}, err
+	}
+	return u.UserRepository.Patch(ctx, id, dto, operation, actor, ifVersion)
+}
+
+func TestPatchUser_IfMatchConcurrentWrite(t *testing.T) {
+	db := setupTestDB(t)
+	deps := testDeps(db)
+	deps.Users = interferingUsers{repository.NewGORM(db)}
+	router := handlers.NewRouter(deps)
+
+	user := models.User{Name: "Raced User", Email: "raced@example.com", Age: 30, Bio: "v1", Role: "user"}
+	if _, err := repository.NewGORM(db).Create(context.Background(), &user, "tester"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("PATCH", fmt.Sprintf("/users/%d", user.ID), bytes.NewBufferString(`{"bio": "mine"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"1"`)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// The check passed at version 1, but the write found version 2
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusPreconditionFailed, w.Code, w.Body.String())
+	}
+	var stored models.User
+	db.First(&stored, user.ID)
+	if stored.Bio != "theirs" {
+		t.Errorf("Expected the concurrent change to be kept, got bio %q", stored.Bio)
+	}
+}
+
+func TestRevertUser_ConcurrentWrite(t *testing.T) {
+	db := setupTestDB(t)
+	deps := testDeps(db)
+	deps.Users = interferingUsers{repository.NewGORM(db)}
+	router := handlers.NewRouter(deps)
+
+	gormUsers := repository.NewGORM(db)
+	user := models.User{Name: "Reverted User", Email: "reverted@example.com", Age: 30, Bio: "v1", Role: "user"}
+	if _, err := gormUsers.Create(context.Background(), &user, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := gormUsers.Patch(context.Background(), user.ID, models.PatchUserDTO{Age: patch.Some(31)}, models.OperationPatch, "tester", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/users/%d/revert", user.ID), bytes.NewBufferString(`{"version": 1}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// The inverse patch was computed at version 2, but the write found version 3
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusPreconditionFailed, w.Code, w.Body.String())
+	}
+	var stored models.User
+	db.First(&stored, user.ID)
+	if stored.Bio != "theirs" || stored.Age != 31 {
+		t.Errorf("Expected the concurrent change to be kept and nothing reverted, got %+v", stored)
+	}
+}
+
+func TestPatchUser_UpdateMask(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/users", `{"name": "Mask User", "email": "mask@example.com", "age": 30, "phone": "1234567890", "bio": "Original"}`)
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	url := fmt.Sprintf("/users/%d", user.ID)
+
+	// The full object is sent, but only name and phone are applied. Phone is
+	// missing from the body and is therefore cleared.
+	full := `{"id": 99, "name": "Masked Name", "email": "other@example.com", "age": 99, "bio": "Ignored", "role": "admin"}`
+	w = send("PATCH", url+"?update_mask=name,phone", full)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var updated models.User
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.Name != "Masked Name" || updated.Phone != nil {
+		t.Errorf("Expected name updated and phone cleared, got %+v", updated)
+	}
+	if updated.ID != user.ID || updated.Email != "mask@example.com" || updated.Age != 30 || updated.Bio != "Original" || updated.Role != "user" {
+		t.Errorf("Expected fields outside the mask to be unchanged, got %+v", updated)
+	}
+
+	tests := []struct {
+		name string
+		mask string
+	}{
+		{"empty mask", ""},
+		{"unknown field", "name,nickname"},
+		{"immutable field", "email"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send("PATCH", url+"?update_mask="+tt.mask, full); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d. Body: %s", http.StatusBadRequest, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Masked fields still go through validation
+	if w := send("PATCH", url+"?update_mask=age", `{"age": 200}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid masked field, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Clearing the other optional fields works like a null in a regular PATCH
+	w = send("PATCH", url+"?update_mask=bio,active,role,score", `{"name": "Ignored"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var cleared models.User
+	json.Unmarshal(w.Body.Bytes(), &cleared)
+	if cleared.Bio != "" || cleared.Active || cleared.Role != "" || cleared.Score != 0 || cleared.Name != "Masked Name" {
+		t.Errorf("Expected bio, active, role and score cleared, got %+v", cleared)
+	}
+
+	// Required fields cannot be cleared, so masking them without a value is
+	// a validation error rather than a database error
+	for _, tt := range []struct{ mask, body, field string }{
+		{"name", `{"age": 5}`, "Name"},
+		{"age", `{}`, "Age"},
+	} {
+		w := send("PATCH", url+"?update_mask="+tt.mask, tt.body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.field+" cannot be null") {
+			t.Errorf("Expected status %d clearing %s, got %d. Body: %s", http.StatusBadRequest, tt.mask, w.Code, w.Body.String())
+		}
+	}
+	var stored models.User
+	db.First(&stored, user.ID)
+	if stored.Name != "Masked Name" || stored.Age != 30 {
+		t.Errorf("Expected name and age to be kept, got %+v", stored)
+	}
+}
+
+func TestStreamUserEvents(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close) // after the streams are closed
+
+	send := func(method, url, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	created := send("POST", "/users", `{"name": "Event User", "email": "events@example.com", "age": 30}`)
+	url := created.Header.Get("Location")
+
+	// A live stream only receives changes made after it was opened
+	live := openEventStream(t, server.URL, "")
+	send("PATCH", url, `{"bio": "Streaming"}`)
+	send("DELETE", url, "")
+
+	patched := live.next(t)
+	if patched.event != models.OperationPatch || patched.entry.Diff["bio"].To != "Streaming" {
+		t.Errorf("Expected patch event with bio diff, got %+v", patched)
+	}
+	deleted := live.next(t)
+	if deleted.event != models.OperationDelete || deleted.entry.Version != 3 {
+		t.Errorf("Expected delete event for version 3, got %+v", deleted)
+	}
+
+	// Resuming after the patch replays the delete from the event log, then
+	// continues with live events
+	resumed := openEventStream(t, server.URL, patched.id)
+	if e := resumed.next(t); e.id != deleted.id || e.event != models.OperationDelete || e.entry.Diff["email"].From != "e***@example.com" {
+		t.Errorf("Expected replayed delete event %s with the email masked, got %+v", deleted.id, e)
+	}
+	send("POST", "/users", `{"name": "Second User", "email": "second@example.com", "age": 40}`)
+	// Like the history, the stream masks emails and phone numbers
+	if e := resumed.next(t); e.event != models.OperationCreate || e.entry.Diff["email"].To != "s***@example.com" {
+		t.Errorf("Expected live create event with the email masked after replay, got %+v", e)
+	}
+	if e := live.next(t); e.event != models.OperationCreate {
+		t.Errorf("Expected create event on the first stream, got %+v", e)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/users/events", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid Last-Event-ID, got %v %v", http.StatusBadRequest, resp, err)
+	}
+}
+
+func TestStreamUserEvents_Heartbeat(t *testing.T) {
+	deps := testDeps(setupTestDB(t))
+	deps.Heartbeat = 20 * time.Millisecond
+	server := httptest.NewServer(handlers.NewRouter(deps))
+	t.Cleanup(server.Close) // after the streams are closed
+
+	stream := openEventStream(t, server.URL, "")
+	select {
+	case line := <-stream.lines:
+		if line != ": heartbeat" {
+			t.Errorf("Expected heartbeat comment, got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for heartbeat")
+	}
+}
+
+func TestStreamUserEvents_OutlivesServerTimeouts(t *testing.T) {
+	server := httptest.NewUnstartedServer(setupTestRouter(t, setupTestDB(t)))
+	server.Config.ReadTimeout = 50 * time.Millisecond
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	t.Cleanup(server.Close) // after the streams are closed
+
+	stream := openEventStream(t, server.URL, "")
+	time.Sleep(150 * time.Millisecond)
+
+	resp, err := http.Post(server.URL+"/users", "application/json", bytes.NewBufferString(`{"name": "Late User", "email": "late@example.com", "age": 30}`))
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	resp.Body.Close()
+
+	if e := stream.next(t); e.event != models.OperationCreate {
+		t.Errorf("Expected create event after the server timeouts, got %+v", e)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	deps := testDeps(setupTestDB(t))
+	deps.MaxBodyBytes = 64
+	router := handlers.NewRouter(deps)
+
+	small := `{"name": "Small", "email": "small@example.com", "age": 30}`
+	large := `{"name": "Large", "email": "large@example.com", "age": 30, "bio": "` + strings.Repeat("x", 100) + `"}`
+
+	req := httptest.NewRequest("POST", "/users", bytes.NewBufferString(small))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected status %d for a small body, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/users", bytes.NewBufferString(large))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for a large body, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	// Without a Content-Length the body is cut off at the limit
+	req = httptest.NewRequest("POST", "/users", io.MultiReader(strings.NewReader(large)))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a large streamed body, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	deliveries := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- received{r.Header, body}
+	}))
+	defer receiver.Close()
+
+	if w := send("POST", "/webhooks", `{"url": "not a url"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid URL, got %d", http.StatusBadRequest, w.Code)
+	}
+	w := send("POST", "/webhooks", fmt.Sprintf(`{"url": %q, "secret": "partner-secret-123"}`, receiver.URL))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var hook models.Webhook
+	json.Unmarshal(w.Body.Bytes(), &hook)
+	if hook.Secret != "partner-secret-123" {
+		t.Errorf("Expected secret in registration response, got %+v", hook)
+	}
+
+	// Secrets are generated when not provided and never listed
+	w = send("POST", "/webhooks", `{"url": "http://example.com/hook"}`)
+	var generated models.Webhook
+	json.Unmarshal(w.Body.Bytes(), &generated)
+	if len(generated.Secret) != 64 {
+		t.Errorf("Expected generated secret, got %q", generated.Secret)
+	}
+	w = send("GET", "/webhooks", "")
+	var hooks []models.Webhook
+	json.Unmarshal(w.Body.Bytes(), &hooks)
+	if len(hooks) != 2 || hooks[0].URL != receiver.URL || hooks[0].Secret != "" || hooks[1].Secret != "" {
+		t.Errorf("Expected 2 webhooks without secrets, got %+v", hooks)
+	}
+	if w := send("DELETE", fmt.Sprintf("/webhooks/%d", generated.ID), ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w := send("DELETE", fmt.Sprintf("/webhooks/%d", generated.ID), ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for deleted webhook, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = send("POST", "/users", `{"name": "Hook User", "email": "hook@example.com", "age": 30}`)
+	url := w.Header().Get("Location")
+	send("PATCH", url, `{"age": 31}`)
+	send("PATCH", url, `{"age": 999}`) // rejected, never queued
+
+	var queued int64
+	db.Model(&models.OutboxMessage{}).Count(&queued)
+	if queued != 2 {
+		t.Fatalf("Expected 2 outbox messages, got %d", queued)
+	}
+
+	if err := webhooks.NewDispatcher(db).RunOnce(context.Background()); err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+
+	for _, event := range []string{models.OperationCreate, models.OperationPatch} {
+		select {
+		case got := <-deliveries:
+			if got.header.Get(webhooks.EventHeader) != event {
+				t.Errorf("Expected %s event, got %q", event, got.header.Get(webhooks.EventHeader))
+			}
+			signature := webhooks.Sign("partner-secret-123", got.header.Get(webhooks.TimestampHeader), got.body)
+			if !hmac.Equal([]byte(got.header.Get(webhooks.SignatureHeader)), []byte(signature)) {
+				t.Errorf("Invalid signature %q", got.header.Get(webhooks.SignatureHeader))
+			}
+			var entry models.UserHistory
+			json.Unmarshal(got.body, &entry)
+			if entry.Operation != event || entry.UserID == 0 {
+				t.Errorf("Unexpected payload: %s", got.body)
+			}
+		default:
+			t.Fatalf("Expected %s delivery", event)
+		}
+	}
+
+	w = send("GET", fmt.Sprintf("/webhooks/%d/deliveries?status=delivered", hook.ID), "")
+	var delivered []models.WebhookDelivery
+	json.Unmarshal(w.Body.Bytes(), &delivered)
+	if len(delivered) != 2 || delivered[0].Attempts != 1 {
+		t.Errorf("Expected 2 delivered deliveries, got %+v", delivered)
+	}
+	if w := send("GET", fmt.Sprintf("/webhooks/%d/deliveries?status=lost", hook.ID), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid status, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestWebhooks_Filters(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	received := make(map[string][]string) // path => events
+	var mu sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[r.URL.Path] = append(received[r.URL.Path], r.Header.Get(webhooks.EventHeader))
+	}))
+	defer receiver.Close()
+
+	register := func(body string) int {
+		return send("POST", "/webhooks", fmt.Sprintf(body, receiver.URL)).Code
+	}
+	if code := register(`{"url": "%s/roles", "fields": ["role"]}`); code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, code)
+	}
+	register(`{"url": "%s/patches", "operations": ["patch"]}`)
+	register(`{"url": "%s/deletes-or-names", "operations": ["delete", "update"], "fields": ["name", "email"]}`)
+	register(`{"url": "%s/all"}`)
+
+	w := send("POST", "/users", `{"name": "Filter User", "email": "filter@example.com", "age": 30}`)
+	url := w.Header().Get("Location")
+	send("PATCH", url, `{"bio": "Only bio"}`)
+	send("PATCH", url, `{"role": "admin"}`)
+	send("PUT", url, `{"name": "Filter User", "age": 31, "active": true, "role": "admin", "score": 10}`)
+	send("DELETE", url, "")
+
+	if err := webhooks.NewDispatcher(db).RunOnce(context.Background()); err != nil {
+		t.Fatalf("Dispatch failed: %v", err)
+	}
+
+	expected := map[string][]string{
+		"/roles":            {models.OperationCreate, models.OperationPatch, models.OperationDelete},
+		"/patches":          {models.OperationPatch, models.OperationPatch},
+		"/deletes-or-names": {models.OperationDelete},
+		"/all":              {models.OperationCreate, models.OperationPatch, models.OperationPatch, models.OperationUpdate, models.OperationDelete},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for path, events := range expected {
+		if !reflect.DeepEqual(received[path], events) {
+			t.Errorf("%s: expected %v, got %v", path, events, received[path])
+		}
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"unknown field", `{"url": "%s", "fields": ["nickname"]}`},
+		{"unknown operation", `{"url": "%s", "operations": ["upsert"]}`},
+		{"duplicate field", `{"url": "%s", "fields": ["role", "role"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := register(tt.body); code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, code)
+			}
+		})
+	}
+}
+
+func TestWatchUser(t *testing.T) {
+	db := setupTestDB(t)
+	router := setupTestRouter(t, db)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close) // after the sockets are closed
+
+	send := func(method, url, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	created := send("POST", "/users", `{"name": "Socket User", "email": "socket@example.com", "age": 30}`)
+	url := created.Header.Get("Location")
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + url + "/ws"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"9", nil); err == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown user, got %v", http.StatusNotFound, resp)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-Actor": {"editor"}})
+	if err != nil {
+		t.Fatalf("Failed to open WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	read := func() handlers.SocketMessage {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg handlers.SocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		return msg
+	}
+
+	snapshot := read()
+	if snapshot.Type != handlers.MessageSnapshot || snapshot.Version != 1 || snapshot.User == nil || snapshot.User.Name != "Socket User" {
+		t.Fatalf("Expected snapshot at version 1, got %+v", snapshot)
+	}
+
+	// Changes made over HTTP are pushed as diffs
+	send("PATCH", url, `{"bio": "From HTTP"}`)
+	send("PUT", url, `{"name": "Socket User", "age": 31, "active": true, "role": "user", "score": 10, "bio": "From HTTP"}`)
+	if msg := read(); msg.Type != handlers.MessageDiff || msg.Version != 2 || msg.Operation != models.OperationPatch || msg.Diff["bio"].To != "From HTTP" {
+		t.Errorf("Expected patch diff at version 2, got %+v", msg)
+	}
+	if msg := read(); msg.Type != handlers.MessageDiff || msg.Version != 3 || msg.Operation != models.OperationUpdate || msg.Diff["age"].To != float64(31) {
+		t.Errorf("Expected update diff at version 3, got %+v", msg)
+	}
+
+	// Patches sent over the socket are acknowledged, then pushed like any other change
+	conn.WriteJSON(map[string]any{"type": "patch", "ref": "p1", "patch": map[string]any{"phone": "1234567890", "bio": nil}})
+	if msg := read(); msg.Type != handlers.MessageAck || msg.Ref != "p1" || msg.Version != 4 {
+		t.Errorf("Expected ack for version 4, got %+v", msg)
+	}
+	if msg := read(); msg.Type != handlers.MessageDiff || msg.Actor != "editor" || msg.Diff["phone"].To != "1234567890" || msg.Diff["bio"].To != "" {
+		t.Errorf("Expected diff of the socket patch, got %+v", msg)
+	}
+
+	conn.WriteJSON(map[string]any{"type": "patch", "ref": "p2", "patch": map[string]any{"age": 200}})
+	if msg := read(); msg.Type != handlers.MessageError || msg.Ref != "p2" || len(msg.Errors) != 1 || msg.Errors[0]["field"] != "Age" {
+		t.Errorf("Expected validation error, got %+v", msg)
+	}
+	conn.WriteJSON(map[string]any{"type": "patch", "ref": "p3", "patch": map[string]any{}})
+	if msg := read(); msg.Type != handlers.MessageError || msg.Error != "No fields to update" {
+		t.Errorf("Expected empty patch error, got %+v", msg)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if msg := read(); msg.Type != handlers.MessageError || msg.Error != "Invalid JSON" {
+		t.Errorf("Expected invalid JSON error, got %+v", msg)
+	}
+
+	var stored models.User
+	db.First(&stored, snapshot.User.ID)
+	if stored.Age != 31 || stored.Phone == nil || *stored.Phone != "1234567890" {
+		t.Errorf("Expected only valid patches to be saved, got %+v", stored)
+	}
+
+	// Deleting the user ends the subscription
+	send("DELETE", url, "")
+	if msg := read(); msg.Type != handlers.MessageDiff || msg.Operation != models.OperationDelete {
+		t.Errorf("Expected delete diff, got %+v", msg)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected normal closure, got %v", err)
+	}
+}
+
+func TestLiveEvents_OutOfOrderPublish(t *testing.T) {
+	deps := testDeps(setupTestDB(t))
+	deps.Events = events.NewBroker()
+	server := httptest.NewServer(handlers.NewRouter(deps))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Post(server.URL+"/users", "application/json", bytes.NewBufferString(`{"name": "Racy User", "email": "racy@example.com", "age": 30}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	url := resp.Header.Get("Location")
+
+	stream := openEventStream(t, server.URL, "")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+url+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to open WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	read := func() handlers.SocketMessage {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg handlers.SocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		return msg
+	}
+	snapshot := read()
+
+	// Two writes commit as versions 2 and 3, but the second publishes first
+	second := models.UserHistory{ID: 10, UserID: snapshot.User.ID, Version: 2, Operation: models.OperationPatch, Diff: patch.Changes{"age": {From: 30, To: 31}}}
+	third := models.UserHistory{ID: 11, UserID: snapshot.User.ID, Version: 3, Operation: models.OperationPatch, Diff: patch.Changes{"bio": {From: "", To: "Later"}}}
+	deps.Events.Publish(third)
+	deps.Events.Publish(second)
+
+	for _, want := range []string{"11", "10"} {
+		if e := stream.next(t); e.id != want {
+			t.Errorf("Expected event %s, got %+v", want, e)
+		}
+	}
+	for _, want := range []uint{3, 2} {
+		if msg := read(); msg.Type != handlers.MessageDiff || msg.Version != want {
+			t.Errorf("Expected diff at version %d, got %+v", want, msg)
+		}
+	}
+}
+
+func TestNewRouter_IndependentStores(t *testing.T) {
+	t.Parallel()
+
+	// Two servers in one process, each with its own database
+	first, second := setupTestRouter(t, setupTestDB(t)), setupTestRouter(t, setupTestDB(t))
+
+	send := func(router *mux.Router, method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(first, "POST", "/users", `{"name": "First Store", "email": "first@example.com", "age": 30}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var users []models.User
+	json.Unmarshal(send(second, "GET", "/users", "").Body.Bytes(), &users)
+	if len(users) != 0 {
+		t.Errorf("Expected the second store to be empty, got %+v", users)
+	}
+	json.Unmarshal(send(first, "GET", "/users", "").Body.Bytes(), &users)
+	if len(users) != 1 || users[0].Name != "First Store" {
+		t.Errorf("Expected the user in the first store, got %+v", users)
+	}
+}
+
+func TestNewRouter_MemoryRepository(t *testing.T) {
+	// Users are kept in memory; the database is never written
+	db := setupTestDB(t)
+	users := repository.NewMemory()
+	deps := testDeps(db)
+	deps.Users = users
+	router := handlers.NewRouter(deps)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/users", `{"name": "Memory User", "email": "memory@example.com", "age": 30, "phone": "5555555555"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+
+	w = send("PATCH", location, `{"age": 31, "phone": null}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Body: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var user models.User
+	json.Unmarshal(send("GET", location, "").Body.Bytes(), &user)
+	if user.Name != "Memory User" || user.Age != 31 || user.Phone != nil {
+		t.Errorf("Expected the patch to be applied, got %+v", user)
+	}
+	if history, _, _ := users.History(context.Background(), user.ID, 0, 0); len(history) != 2 || history[0].Operation != models.OperationPatch {
+		t.Errorf("Expected create and patch history entries, got %+v", history)
+	}
+
+	// Versions, history, dry runs and reverts go through the repository too
+	if w := send("GET", location, ""); w.Header().Get("ETag") != `"2"` {
+		t.Errorf("Expected ETag \"2\", got %q", w.Header().Get("ETag"))
+	}
+	if w := send("PATCH", location+"?dry_run=true", `{"age": 40}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"age":{"from":31,"to":40}`) {
+		t.Errorf("Expected a dry run diff, got %d. Body: %s", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("PATCH", location, bytes.NewBufferString(`{"bio": "Matched"}`))
+	req.Header.Set("If-Match", `"2"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"3"` {
+		t.Errorf("Expected If-Match on the current version to apply, got %d %q. Body: %s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+	var page handlers.HistoryPage
+	json.Unmarshal(send("GET", location+"/history", "").Body.Bytes(), &page)
+	if page.Total != 3 || len(page.Items) != 3 || page.Items[0].Version != 3 {
+		t.Errorf("Expected 3 history entries, got %+v", page)
+	}
+	if w := send("POST", location+"/revert", `{"version": 1}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"phone":"5555555555"`) {
+		t.Errorf("Expected the revert to restore the phone, got %d. Body: %s", w.Code, w.Body.String())
+	}
+
+	// Missed events are replayed from the repository's history
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close) // after the stream is closed
+	stream := openEventStream(t, server.URL, fmt.Sprint(page.Items[2].ID))
+	for _, want := range []string{models.OperationPatch, models.OperationPatch, models.OperationRevert} {
+		if e := stream.next(t); e.event != want {
+			t.Errorf("Expected a replayed %s event, got %+v", want, e)
+		}
+	}
+
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no users in the database, got %d", count)
+	}
+
+	if w := send("DELETE", location, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w := send("GET", location, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestWatchUser_RefusedWhileShuttingDown(t *testing.T) {
+	db := setupTestDB(t)
+	api := handlers.NewServer(testDeps(db))
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+
+	user := models.User{Name: "Late Watcher", Email: "late@example.com", Age: 30}
+	db.Create(&user)
+	wsURL := fmt.Sprintf("ws%s/users/%d/ws", strings.TrimPrefix(server.URL, "http"), user.ID)
+
+	// Sockets opened while Drain starts are either waited for or refused
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := api.Drain(ctx); err != nil {
+		t.Errorf("Expected the drain to finish, got %v", err)
+	}
+	wg.Wait()
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d after the shutdown began, got %v (%v)", http.StatusServiceUnavailable, resp, err)
+	}
+}
+
+func TestShutdown_DrainsInFlightRequests(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database.DSN = filepath.Join(t.TempDir(), "app.db")
+	a, err := newApp(cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("Failed to start app: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.serve(ln)
+	baseURL := "http://" + ln.Addr().String()
+
+	resp, err := http.Post(baseURL+"/users", "application/json", bytes.NewBufferString(`{"name": "Draining", "email": "draining@example.com", "age": 30}`))
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	var user models.User
+	json.NewDecoder(resp.Body).Decode(&user)
+	resp.Body.Close()
+
+	// Open event streams and WebSockets must not hold up the shutdown
+	stream := openEventStream(t, baseURL, "")
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/users/%d/ws", ln.Addr(), user.ID), nil)
+	if err != nil {
+		t.Fatalf("Failed to open WebSocket: %v", err)
+	}
+	defer conn.Close()
+	conn.ReadMessage() // snapshot
+
+	// Hold the PATCH inside its transaction while the shutdown starts
+	started := make(chan struct{})
+	var once sync.Once
+	a.db.Callback().Update().Before("gorm:update").Register("test:slow_update", func(*gorm.DB) {
+		once.Do(func() { close(started) })
+		time.Sleep(200 * time.Millisecond)
+	})
+	patched := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/users/%d", baseURL, user.ID), bytes.NewBufferString(`{"age": 31}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("PATCH failed during shutdown: %v", err)
+		}
+		patched <- resp
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	begin := time.Now()
+	if err := a.shutdown(ctx); err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("Expected the shutdown not to wait for the event stream, took %v", elapsed)
+	}
+
+	resp = <-patched
+	if resp == nil {
+		t.FailNow()
+	}
+	var updated models.User
+	json.NewDecoder(resp.Body).Decode(&updated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || updated.Age != 31 {
+		t.Errorf("Expected the in-flight PATCH to complete, got %d %+v", resp.StatusCode, updated)
+	}
+
+	for range stream.lines {
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("Expected the WebSocket to be closed as going away, got %v", err)
+			}
+			break
+		}
+	}
+	select {
+	case <-a.workersDone:
+	default:
+		t.Error("Expected the webhook dispatcher to be stopped")
+	}
+	sqlDB, _ := a.db.DB()
+	if sqlDB.Ping() == nil {
+		t.Error("Expected the database to be closed")
+	}
+}
+
+// slowDown registers a GORM callback that takes delay, or until the query's
+// context ends, like a query that is stuck on a lock
+func slowDown(t *testing.T, register func(string, func(*gorm.DB)) error, delay time.Duration) {
+	t.Helper()
+	err := register("test:slow", func(db *gorm.DB) {
+		select {
+		case <-time.After(delay):
+		case <-db.Statement.Context.Done():
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// A cancelled query discards its connection, and with it an in-memory
+	// database, so this test needs a file
+	cfg := config.Default().Database
+	cfg.DSN = filepath.Join(t.TempDir(), "app.db")
+	db, err := database.Open(cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	deps := testDeps(db)
+	deps.RequestTimeout = 50 * time.Millisecond
+	router := handlers.NewRouter(deps)
+
+	user := models.User{Name: "Slow User", Email: "slow@example.com", Age: 30, Active: true, Role: "user"}
+	db.Create(&user)
+	url := fmt.Sprintf("/users/%d", user.ID)
+
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// A PATCH stuck in its UPDATE is rolled back when the deadline passes
+	slowDown(t, db.Callback().Update().Before("gorm:update").Register, time.Second)
+	begin := time.Now()
+	w := send(httptest.NewRequest("PATCH", url, bytes.NewBufferString(`{"age": 31}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to stop at its deadline, took %v", elapsed)
+	}
+	var stored models.User
+	db.First(&stored, user.ID)
+	var entries int64
+	db.Model(&models.UserHistory{}).Where("user_id = ?", user.ID).Count(&entries)
+	if stored.Age != 30 || entries != 0 {
+		t.Errorf("Expected the timed out patch to be rolled back, got age %d and %d history entries", stored.Age, entries)
+	}
+
+	// Reads stuck in a query time out as well
+	slowDown(t, db.Callback().Query().Before("gorm:query").Register, time.Second)
+	if w := send(httptest.NewRequest("GET", url, nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d. Body: %s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+
+	// A request the client has abandoned is answered with 499
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if w := send(httptest.NewRequest("GET", "/users", nil).WithContext(ctx)); w.Code != handlers.StatusClientClosedRequest {
+		t.Errorf("Expected status %d, got %d. Body: %s", handlers.StatusClientClosedRequest, w.Code, w.Body.String())
+	}
+}
+
+func TestRequestTimeout_ExemptsStreams(t *testing.T) {
+	deps := testDeps(setupTestDB(t))
+	deps.RequestTimeout = 20 * time.Millisecond
+	server := httptest.NewServer(handlers.NewRouter(deps))
+	t.Cleanup(server.Close) // after the streams are closed
+
+	stream := openEventStream(t, server.URL, "")
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Post(server.URL+"/users", "application/json", bytes.NewBufferString(`{"name": "Later User", "email": "later@example.com", "age": 30}`))
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	if e := stream.next(t); e.event != models.OperationCreate {
+		t.Errorf("Expected create event after the request timeout, got %+v", e)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	db := setupTestDB(t)
+	user := models.User{Name: "Logged User", Email: "logged@example.com", Age: 30, Active: true, Role: "user"}
+	db.Create(&user)
+
+	// Queries of the router are logged too, with the request ID
+	var logs bytes.Buffer
+	logger := logging.New(&logs, "debug")
+	deps := testDeps(db.Session(&gorm.Session{Logger: logging.NewGORMLogger(logger)}))
+	deps.Logger = logger
+	router := handlers.NewRouter(deps)
+
+	send := func(req *http.Request, requestID string) (*httptest.ResponseRecorder, []map[string]any) {
+		logs.Reset()
+		if requestID != "" {
+			req.Header.Set(logging.RequestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var lines []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]any
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Invalid log line %q: %v", line, err)
+			}
+			lines = append(lines, entry)
+		}
+		return w, lines
+	}
+	find := func(lines []map[string]any, msg string) map[string]any {
+		for _, line := range lines {
+			if line["msg"] == msg {
+				return line
+			}
+		}
+		t.Fatalf("No %q log line in %v", msg, lines)
+		return nil
+	}
+
+	// A valid client ID is propagated
+	w, lines := send(httptest.NewRequest("GET", fmt.Sprintf("/users/%d", user.ID), nil), "client-id-42")
+	if got := w.Header().Get(logging.RequestIDHeader); got != "client-id-42" {
+		t.Errorf("Expected the request ID to be echoed, got %q", got)
+	}
+	access := find(lines, "Request")
+	want := map[string]any{
+		"level":      "INFO",
+		"method":     "GET",
+		"route":      "/users/{id}",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(w.Body.Len()),
+		"request_id": "client-id-42",
+	}
+	for key, value := range want {
+		if access[key] != value {
+			t.Errorf("Expected %s %v in access log, got %v", key, value, access[key])
+		}
+	}
+	if _, ok := access["latency_ms"].(float64); !ok {
+		t.Errorf("Expected latency in access log, got %v", access)
+	}
+	if query := find(lines, "SQL"); query["request_id"] != "client-id-42" || !strings.Contains(query["sql"].(string), "users") {
+		t.Errorf("Expected the query to be logged with the request ID, got %v", query)
+	}
+
+	// Missing and invalid IDs are replaced with a generated one
+	for _, requestID := range []string{"", "not a valid id", strings.Repeat("x", 129)} {
+		w, lines := send(httptest.NewRequest("GET", "/users", nil), requestID)
+		generated := w.Header().Get(logging.RequestIDHeader)
+		if len(generated) != 32 || generated == requestID {
+			t.Errorf("Expected a generated request ID for %q, got %q", requestID, generated)
+		}
+		if access := find(lines, "Request"); access["request_id"] != generated {
+			t.Errorf("Expected the generated request ID %q in the access log, got %v", generated, access["request_id"])
+		}
+	}
+
+	// Requests that match no route are logged as well
+	w, lines = send(httptest.NewRequest("GET", "/nothing/here", nil), "")
+	access = find(lines, "Request")
+	if w.Code != http.StatusNotFound || access["route"] != "unmatched" || access["status"] != float64(http.StatusNotFound) {
+		t.Errorf("Expected an unmatched 404 in the access log, got %d %v", w.Code, access)
+	}
+	w, lines = send(httptest.NewRequest("PUT", "/users", nil), "")
+	if access := find(lines, "Request"); w.Code != http.StatusMethodNotAllowed || access["status"] != float64(http.StatusMethodNotAllowed) {
+		t.Errorf("Expected a 405 in the access log, got %d %v", w.Code, access)
+	}
+
+	// Error responses carry the request ID
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w, _ = send(httptest.NewRequest("GET", "/users", nil).WithContext(ctx), "failing-request")
+	if w.Code != handlers.StatusClientClosedRequest || !strings.Contains(w.Body.String(), "request ID failing-request") {
+		t.Errorf("Expected the request ID in the error response, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRedaction_NoPIILeaks(t *testing.T) {
+	const email, phone = "private.person@example.com", "+1 (555) 867-5309"
+	db := setupTestDB(t)
+	user := models.User{Name: "Private Person", Email: email, Age: 30, Phone: stringPtr(phone), Active: true, Role: "user"}
+	db.Create(&user)
+	db.Create(&models.UserHistory{UserID: user.ID, Version: 1, Operation: models.OperationCreate, Actor: "test",
+		Diff: patch.Changes{"email": {From: nil, To: email}, "phone": {From: nil, To: phone}}})
+
+	var logs bytes.Buffer
+	logger := logging.New(&logs, "debug")
+	deps := testDeps(db.Session(&gorm.Session{Logger: logging.NewGORMLogger(logger)}))
+	deps.Logger = logger
+	server := httptest.NewServer(handlers.NewRouter(deps))
+	t.Cleanup(server.Close) // after the socket is closed
+
+	// Driver errors may quote the values that caused them; fail every
+	// statement with one, after it ran so that it is logged as well
+	var leak atomic.Bool
+	failing := func(db *gorm.DB) {
+		if leak.Load() {
+			db.AddError(fmt.Errorf("constraint failed for %s, %s", email, phone))
+		}
+	}
+	callbacks := db.Callback()
+	for name, register := range map[string]func(string, func(*gorm.DB)) error{
+		"gorm:create": callbacks.Create().After("gorm:create").Register,
+		"gorm:query":  callbacks.Query().After("gorm:query").Register,
+		"gorm:update": callbacks.Update().After("gorm:update").Register,
+		"gorm:delete": callbacks.Delete().After("gorm:delete").Register,
+		"gorm:row":    callbacks.Row().After("gorm:row").Register,
+	} {
+		if err := register("test:leak_pii", failing); err != nil {
+			t.Fatalf("Failed to register after %s: %v", name, err)
+		}
+	}
+
+	assertNoPII := func(context, output string) {
+		t.Helper()
+		if strings.Contains(output, email) || strings.Contains(output, phone) {
+			t.Errorf("%s leaks personal data: %s", context, output)
+		}
+	}
+	userURL := fmt.Sprintf("/users/%d", user.ID)
+	asOf := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339Nano))
+	body := fmt.Sprintf(`{"name": "Private Person", "email": %q, "age": 30, "phone": %q, "role": "user", "score": 1}`, email, phone)
+
+	tests := []struct {
+		name         string
+		method, url  string
+		body         string
+		leak         bool
+		expectedCode int
+	}{
+		{"create with duplicate email", "POST", "/users", body, false, http.StatusConflict},
+		{"create with invalid phone", "POST", "/users", `{"name": "Private Person", "email": "private.person@example.com", "age": 30, "phone": "+1 (555) 867-5309 ext. 12345"}`, false, http.StatusBadRequest},
+		{"create", "POST", "/users", strings.Replace(body, "private.person", "other.person", 1), true, http.StatusInternalServerError},
+		{"list", "GET", "/users", "", true, http.StatusInternalServerError},
+		{"get", "GET", userURL, "", true, http.StatusInternalServerError},
+		{"get as of", "GET", userURL + "?as_of=" + asOf, "", true, http.StatusInternalServerError},
+		{"update", "PUT", userURL, body, true, http.StatusInternalServerError},
+		{"patch", "PATCH", userURL, fmt.Sprintf(`{"phone": %q}`, phone), true, http.StatusInternalServerError},
+		{"patch dry run", "PATCH", userURL + "?dry_run=true", fmt.Sprintf(`{"phone": %q}`, phone), true, http.StatusInternalServerError},
+		{"history", "GET", userURL + "/history", "", true, http.StatusInternalServerError},
+		{"revert", "POST", userURL + "/revert", `{"version": 1}`, true, http.StatusInternalServerError},
+		{"delete", "DELETE", userURL, "", true, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			leak.Store(tt.leak)
+			defer leak.Store(false)
+
+			req, _ := http.NewRequest(tt.method, server.URL+tt.url, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.method, tt.url, err)
+			}
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedCode, resp.StatusCode, respBody)
+			}
+			assertNoPII("Response", string(respBody))
+			assertNoPII("Log", logs.String())
+			if tt.leak && !strings.Contains(string(respBody), "p***@example.com") {
+				t.Errorf("Expected the masked email in the error, got %s", respBody)
+			}
+			if tt.leak && !strings.Contains(logs.String(), `"msg":"SQL failed"`) {
+				t.Errorf("Expected the failed statement to be logged, got %s", logs.String())
+			}
+		})
+	}
+
+	// Patches sent over a WebSocket fail the same way
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + userURL + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to open WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg handlers.SocketMessage
+	conn.ReadJSON(&msg) // snapshot
+
+	leak.Store(true)
+	conn.WriteJSON(map[string]any{"type": "patch", "ref": "p1", "patch": map[string]any{"phone": phone}})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != handlers.MessageError {
+		t.Fatalf("Expected an error message, got %+v, %v", msg, err)
+	}
+	leak.Store(false)
+	assertNoPII("WebSocket error", msg.Error)
+
+	// The history shows what changed, but masks the values
+	resp, err := http.Get(server.URL + userURL + "/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page handlers.HistoryPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if len(page.Items) != 1 {
+		t.Fatalf("Expected 1 history entry, got %+v", page)
+	}
+	diff := page.Items[0].Diff
+	if diff["email"].To != "p***@example.com" || diff["phone"].To != "***5309" || diff["email"].From != nil {
+		t.Errorf("Expected masked email and phone in the history, got %v", diff)
+	}
+}
+
+// panickingUsers is a repository whose lookups panic, like a handler bug
+type panickingUsers struct {
+	repository.UserRepository
+}
+
+func (panickingUsers) Get(context.Context, uint) (models.User, error) {
+	panic("user store corrupted")
+}
+
+func (panickingUsers) GetVersion(context.Context, uint) (models.User, uint, error) {
+	panic("user store corrupted")
+}
+
+func TestRecoverPanics(t *testing.T) {
+	db := setupTestDB(t)
+	var logs bytes.Buffer
+	deps := testDeps(db)
+	deps.Logger = logging.New(&logs, "info")
+	deps.Users = panickingUsers{repository.NewGORM(db)}
+	router := handlers.NewRouter(deps)
+
+	req := httptest.NewRequest("PATCH", "/users/1", bytes.NewBufferString(`{"name": "Jane Doe"}`))
+	req.Header.Set(logging.RequestIDHeader, "panicking-request")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") != problem.ContentType {
+		t.Fatalf("Expected a 500 problem response, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var details problem.Details
+	if err := json.NewDecoder(w.Body).Decode(&details); err != nil {
+		t.Fatalf("Failed to decode problem: %v", err)
+	}
+	want := problem.Details{
+		Type:      "about:blank",
+		Title:     "Internal Server Error",
+		Status:    http.StatusInternalServerError,
+		Detail:    "The server hit an unexpected error",
+		Instance:  "/users/1",
+		RequestID: "panicking-request",
+	}
+	if details != want {
+		t.Errorf("Expected %+v, got %+v", want, details)
+	}
+	if w.Header().Get(logging.RequestIDHeader) != "panicking-request" {
+		t.Errorf("Expected the request ID header to be kept, got %v", w.Header())
+	}
+
+	// The panic is logged with its stack, and the request as a 500
+	var panicked, logged bool
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		json.Unmarshal([]byte(line), &entry)
+		switch entry["msg"] {
+		case "Panic":
+			stack, _ := entry["stack"].(string)
+			panicked = entry["request_id"] == "panicking-request" && entry["error"] == "user store corrupted" &&
+				strings.Contains(stack, "panickingUsers.Get")
+		case "Request":
+			logged = entry["status"] == float64(http.StatusInternalServerError)
+		}
+	}
+	if !panicked || !logged {
+		t.Errorf("Expected the panic and the request to be logged, got %s", logs.String())
+	}
+
+	// The server keeps serving
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/users", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d after a panic, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	db := setupTestDB(t)
+	deps := testDeps(db)
+	deps.Metrics = metrics.New()
+	if err := deps.Metrics.InstrumentDB(db); err != nil {
+		t.Fatal(err)
+	}
+	router := handlers.NewRouter(deps)
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send("POST", "/users", `{"name": "Metered User", "email": "metered@example.com", "age": 30}`)
+	send("POST", "/users", `{"name": "M", "email": "not an email", "age": 30}`)
+	send("PATCH", "/users/1", `{"age": 31, "bio": null}`)
+	send("PATCH", "/users/1", `{"age": 200}`)
+	send("GET", "/users/1", "")
+	send("GET", "/users/2", "")
+	send("FROBNICATE", "/users/1", "")
+
+	w := send("GET", "/metrics", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != metrics.ContentType {
+		t.Fatalf("Expected metrics, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		`http_requests_total{method="POST",route="/users",status="201"} 1`,
+		`http_requests_total{method="POST",route="/users",status="400"} 1`,
+		`http_requests_total{method="GET",route="/users/{id}",status="200"} 1`,
+		`http_requests_total{method="GET",route="/users/{id}",status="404"} 1`,
+		`http_requests_total{method="other",route="unmatched",status="405"} 1`,
+		`http_request_duration_seconds_count{method="PATCH",route="/users/{id}",status="200"} 1`,
+		`http_request_duration_seconds_bucket{method="PATCH",route="/users/{id}",status="200",le="+Inf"} 1`,
+		`validation_failures_total{field="Name",tag="min"} 1`,
+		`validation_failures_total{field="Email",tag="email"} 1`,
+		`validation_failures_total{field="Age",tag="opt"} 1`,
+		`patch_fields_total{field="age",state="value"} 2`,
+		`patch_fields_total{field="bio",state="null"} 1`,
+		`patch_fields_total{field="bio",state="unset"} 1`,
+		`patch_fields_total{field="name",state="unset"} 2`,
+		`db_query_duration_seconds_count{operation="create",table="users"} 1`,
+		`db_open_connections 1`,
+		`# TYPE db_wait_duration_seconds_total counter`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, body)
+		}
+	}
+
+	// Patches sent over a WebSocket are counted too
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close) // after the socket is closed
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/users/1/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to open WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var msg handlers.SocketMessage
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	conn.ReadJSON(&msg) // snapshot
+	conn.WriteJSON(map[string]any{"type": "patch", "patch": map[string]any{"name": "N"}})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != handlers.MessageError {
+		t.Fatalf("Expected a validation error, got %+v, %v", msg, err)
+	}
+	if got := deps.Metrics.PatchFields.Value("name", patch.StateValue); got != 1 {
+		t.Errorf("Expected 1 name value, got %v", got)
+	}
+	if got := deps.Metrics.ValidationFailures.Value("Name", "opt"); got != 1 {
+		t.Errorf("Expected 1 Name failure, got %v", got)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	db := setupTestDB(t)
+	deps := testDeps(db)
+	var workersErr error
+	deps.ReadinessChecks = map[string]handlers.Check{
+		"workers": func(context.Context) error { return workersErr },
+	}
+	api := handlers.NewServer(deps)
+	router := api.Router()
+
+	get := func(url string) (int, handlers.HealthReport) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var report handlers.HealthReport
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatalf("Failed to decode %s: %v", url, err)
+		}
+		return w.Code, report
+	}
+	failing := func(report handlers.HealthReport) map[string]string {
+		errs := map[string]string{}
+		for name, check := range report.Checks {
+			if check.Status != handlers.CheckOK {
+				errs[name] = check.Error
+			}
+		}
+		return errs
+	}
+
+	code, report := get("/healthz")
+	if code != http.StatusOK || report.Status != handlers.CheckOK || len(report.Checks) != 0 {
+		t.Errorf("Expected a healthy process, got %d %+v", code, report)
+	}
+
+	code, report = get("/readyz")
+	if code != http.StatusOK || report.Status != handlers.CheckOK || len(report.Checks) != 4 {
+		t.Fatalf("Expected ready, got %d %+v", code, report)
+	}
+	for _, name := range []string{"database", "migrations", "shutdown", "workers"} {
+		if check, ok := report.Checks[name]; !ok || check.Status != handlers.CheckOK || check.LatencyMS < 0 {
+			t.Errorf("Expected a passing %s check with its latency, got %+v", name, report.Checks)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		cause func()
+		want  map[string]string
+	}{
+		{"workers stopped", func() { workersErr = errors.New("webhook dispatcher is not running") },
+			map[string]string{"workers": "webhook dispatcher is not running"}},
+		{"migration missing", func() { db.Migrator().DropColumn(&models.User{}, "bio") },
+			map[string]string{"migrations": "column users.bio is missing"}},
+		{"shutting down", api.BeginShutdown,
+			map[string]string{"shutdown": "server is shutting down"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cause()
+			code, report := get("/readyz")
+			if code != http.StatusServiceUnavailable || report.Status != handlers.CheckFail {
+				t.Errorf("Expected not ready, got %d %+v", code, report)
+			}
+			for name, want := range tt.want {
+				if got := failing(report)[name]; got != want {
+					t.Errorf("Expected %s to fail with %q, got %+v", name, want, report.Checks)
+				}
+			}
+		})
+	}
+
+	// A closed database fails its check, but the process is still alive
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+	if _, report := get("/readyz"); failing(report)["database"] == "" {
+		t.Errorf("Expected the database check to fail, got %+v", report.Checks)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz to pass without a database, got %d", code)
+	}
+}
+
+func TestShutdown_FailsReadinessFirst(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database.DSN = filepath.Join(t.TempDir(), "app.db")
+	cfg.HTTP.ShutdownDelay = 300 * time.Millisecond
+	a, err := newApp(cfg, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("Failed to start app: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.serve(ln)
+	readyz := func() (int, handlers.HealthReport) {
+		t.Helper()
+		resp, err := http.Get("http://" + ln.Addr().String() + "/readyz")
+		if err != nil {
+			t.Fatalf("Readiness probe failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var report handlers.HealthReport
+		json.NewDecoder(resp.Body).Decode(&report)
+		return resp.StatusCode, report
+	}
+
+	// The workers start in the background
+	deadline := time.Now().Add(2 * time.Second)
+	code, report := readyz()
+	for code != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		code, report = readyz()
+	}
+	if code != http.StatusOK || report.Checks["workers"].Status != handlers.CheckOK {
+		t.Fatalf("Expected the app to become ready, got %d %+v", code, report)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- a.shutdown(context.Background()) }()
+
+	// Readiness fails during the delay, while requests are still served
+	time.Sleep(50 * time.Millisecond)
+	code, report = readyz()
+	if code != http.StatusServiceUnavailable || report.Checks["shutdown"].Status != handlers.CheckFail {
+		t.Errorf("Expected readiness to fail during the shutdown, got %d %+v", code, report)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Expected a clean shutdown, got %v", err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String() + "/healthz"); err == nil {
+		t.Error("Expected the server to be stopped")
+	}
+}
+
+// eventStream reads Server-Sent Events line by line
+type eventStream struct {
+	lines chan string
+}
+
+type streamedEvent struct {
+	id    string
+	event string
+	entry models.UserHistory
+}
+
+func openEventStream(t *testing.T, baseURL, lastEventID string) *eventStream {
+	req, _ := http.NewRequest("GET", baseURL+"/users/events", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	stream := &eventStream{lines: make(chan string, 100)}
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			stream.lines <- scanner.Text()
+		}
+		close(stream.lines)
+	}()
+	return stream
+}
+
+// next returns the next event, skipping heartbeats
+func (s *eventStream) next(t *testing.T) streamedEvent {
+	var e streamedEvent
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				t.Fatal("Event stream closed")
+			}
+			switch {
+			case line == "" && e.id != "":
+				return e
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.entry)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for event")
+		}
+	}
+}
+
 // Helper function to create string pointer
 func stringPtr(s string) *string {
 	return &s
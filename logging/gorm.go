@@ -0,0 +1,116 @@
+package logging
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"golang-http-patch/models"
+	"golang-http-patch/redact"
+
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
+)
+
+// DefaultSlowThreshold is how long a query may take before it is logged as
+// slow
+const DefaultSlowThreshold = 200 * time.Millisecond
+
+// GORMLogger logs GORM queries to a slog logger: every statement at debug,
+// slow ones at warn and failed ones at error, with the request ID of the
+// query's context. The logger's level decides what is logged. Personal data
+// in query parameters and errors is masked by Redaction.
+type GORMLogger struct {
+	Logger        *slog.Logger
+	SlowThreshold time.Duration
+	Redaction     redact.Rules
+}
+
+// NewGORMLogger returns a GORM logger writing to logger, masking the
+// personal data of users
+func NewGORMLogger(logger *slog.Logger) *GORMLogger {
+	return &GORMLogger{Logger: logger, SlowThreshold: DefaultSlowThreshold, Redaction: models.UserRedaction}
+}
+
+// LogMode is a no-op, since the slog logger has a level of its own
+func (l *GORMLogger) LogMode(gormlogger.LogLevel) gormlogger.Interface {
+	return l
+}
+
+func (l *GORMLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	l.Logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+}
+
+func (l *GORMLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	l.Logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+}
+
+func (l *GORMLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	l.Logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+}
+
+// ParamsFilter masks personal data in the parameters of logged statements,
+// including serialized ones such as JSON diffs and outbox payloads. It only
+// changes what is logged, not what is sent to the database.
+func (l *GORMLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	filtered := make([]interface{}, len(params))
+	for i, param := range params {
+		filtered[i] = l.filterParam(param)
+	}
+	return sql, filtered
+}
+
+func (l *GORMLogger) filterParam(param interface{}) interface{} {
+	switch v := param.(type) {
+	case string:
+		return l.Redaction.Text(v)
+	case *string:
+		if v != nil {
+			return l.Redaction.Text(*v)
+		}
+	case []byte:
+		return l.Redaction.Text(string(v))
+	case driver.Valuer:
+		// Serializer fields are only turned into their column value here
+		value, err := v.Value()
+		if err != nil {
+			return param
+		}
+		switch value.(type) {
+		case string, []byte:
+			return l.filterParam(value)
+		}
+	}
+	return param
+}
+
+func (l *GORMLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+
+	level, msg := slog.LevelDebug, "SQL"
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		level, msg = slog.LevelError, "SQL failed"
+	case l.SlowThreshold > 0 && elapsed > l.SlowThreshold:
+		level, msg = slog.LevelWarn, "Slow SQL"
+	}
+	if !l.Logger.Enabled(ctx, level) {
+		return
+	}
+
+	sql, rows := fc()
+	attrs := []slog.Attr{
+		slog.String("sql", sql),
+		slog.Int64("rows", rows),
+		slog.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+		slog.String("caller", utils.FileWithLineNum()),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", l.Redaction.Text(err.Error())))
+	}
+	l.Logger.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,171 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang-http-patch/logging"
+	"golang-http-patch/models"
+	"golang-http-patch/repository"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// decode returns the JSON log lines written to buf
+func decode(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestNew_AddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(&buf, "info").With("component", "test")
+
+	ctx := logging.WithRequestID(context.Background(), "abc")
+	logger.InfoContext(ctx, "with ID")
+	logger.Info("without ID")
+	logger.Debug("below level")
+
+	lines := decode(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %v", lines)
+	}
+	if lines[0]["request_id"] != "abc" || lines[0]["component"] != "test" {
+		t.Errorf("Expected the request ID and attributes, got %v", lines[0])
+	}
+	if _, ok := lines[1]["request_id"]; ok {
+		t.Errorf("Expected no request ID without one in the context, got %v", lines[1])
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := map[string]bool{
+		"":                       false,
+		"abc-123_DEF.456":        true,
+		"with space":             false,
+		"tab\there":              false,
+		"ünicode":                false,
+		strings.Repeat("x", 128): true,
+		strings.Repeat("x", 129): false,
+	}
+	for id, want := range tests {
+		if got := logging.ValidRequestID(id); got != want {
+			t.Errorf("ValidRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+	if id := logging.NewRequestID(); !logging.ValidRequestID(id) || id == logging.NewRequestID() {
+		t.Errorf("Expected unique valid generated IDs, got %q", id)
+	}
+}
+
+func TestGORMLogger_Trace(t *testing.T) {
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	query := func() (string, int64) { return "SELECT * FROM users", 3 }
+
+	tests := []struct {
+		name    string
+		level   string
+		elapsed time.Duration
+		err     error
+		want    string // message logged, "" for none
+	}{
+		{"statement at debug", "debug", 0, nil, "SQL"},
+		{"statement at info", "info", 0, nil, ""},
+		{"slow statement", "info", time.Second, nil, "Slow SQL"},
+		{"failed statement", "error", 0, errors.New("disk I/O error"), "SQL failed"},
+		{"record not found", "info", 0, gorm.ErrRecordNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logging.NewGORMLogger(logging.New(&buf, tt.level))
+			logger.Trace(ctx, time.Now().Add(-tt.elapsed), query, tt.err)
+
+			lines := decode(t, &buf)
+			if tt.want == "" {
+				if len(lines) != 0 {
+					t.Errorf("Expected nothing logged, got %v", lines)
+				}
+				return
+			}
+			if len(lines) != 1 || lines[0]["msg"] != tt.want {
+				t.Fatalf("Expected a %q line, got %v", tt.want, lines)
+			}
+			if lines[0]["request_id"] != "req-1" || lines[0]["sql"] != "SELECT * FROM users" || lines[0]["rows"] != float64(3) {
+				t.Errorf("Expected the query with its request ID, got %v", lines[0])
+			}
+			if tt.err != nil && lines[0]["error"] != tt.err.Error() {
+				t.Errorf("Expected the error, got %v", lines[0])
+			}
+		})
+	}
+}
+
+func TestGORMLogger_RedactsPersonalData(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.NewGORMLogger(logging.New(&buf, "debug"))
+	phone := "5558675309"
+
+	sql, params := logger.ParamsFilter(context.Background(), "INSERT INTO users VALUES (?,?,?,?)", "jane@example.com", &phone, "Jane", 30)
+	if want := []interface{}{"j***@example.com", "***5309", "Jane", 30}; !reflect.DeepEqual(params, want) {
+		t.Errorf("Expected params %v, got %v", want, params)
+	}
+	if sql != "INSERT INTO users VALUES (?,?,?,?)" {
+		t.Errorf("Expected the statement to be kept, got %q", sql)
+	}
+
+	query := func() (string, int64) { return sql, 0 }
+	logger.Trace(context.Background(), time.Now(), query, errors.New("duplicate jane@example.com"))
+	logging.New(&buf, "info").Error("Failed", "error", errors.New("no such user "+phone))
+
+	if strings.Contains(buf.String(), "jane@example.com") || strings.Contains(buf.String(), phone) {
+		t.Errorf("Expected personal data to be masked in errors, got %s", buf.String())
+	}
+
+	// A real create logs the history diff and the outbox payload as well,
+	// which only become strings when GORM serializes them
+	buf.Reset()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	if err := models.AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	phone = "5551234567"
+	user := models.User{Name: "Jane", Email: "jane.secret@example.com", Age: 30, Phone: &phone}
+	if _, err := repository.NewGORM(db).Create(context.Background(), &user, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := buf.String()
+	for _, table := range []string{"INSERT INTO `user_history`", "INSERT INTO `outbox`"} {
+		if !strings.Contains(logged, table) {
+			t.Errorf("Expected %s to be logged, got %s", table, logged)
+		}
+	}
+	if strings.Contains(logged, "jane.secret@example.com") || strings.Contains(logged, phone) {
+		t.Errorf("Expected personal data to be masked in logged statements, got %s", logged)
+	}
+}
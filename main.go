@@ -1,34 +1,191 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"golang-http-patch/config"
 	"golang-http-patch/database"
 	"golang-http-patch/handlers"
+	"golang-http-patch/logging"
+	"golang-http-patch/metrics"
 	"golang-http-patch/validation"
+	"golang-http-patch/webhooks"
 
-	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 func main() {
-	// Initialize database
-	database.InitDB()
+	// Load configuration from flags, APP_* variables and an optional file
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 
-	// Initialize validator
-	validation.InitValidator()
+	// Log JSON lines; the standard logger goes through it too
+	logger := logging.New(os.Stderr, cfg.LogLevel)
+	slog.SetDefault(logger)
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
 
-	// Create router
-	r := mux.NewRouter()
+	a, err := newApp(cfg, logger)
+	if err != nil {
+		fatal("Failed to open database", err)
+	}
+	logger.Info("Database connected and migrated successfully")
 
-	// Define routes
-	r.HandleFunc("/users", handlers.GetUsers).Methods("GET")
-	r.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
-	r.HandleFunc("/users", handlers.CreateUser).Methods("POST")
-	r.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
-	r.HandleFunc("/users/{id}", handlers.PatchUser).Methods("PATCH")
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fatal("Failed to listen", err)
+	}
 
-	// Start server
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	// Serve until SIGINT or SIGTERM; a second signal kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() { served <- a.serve(ln) }()
+	logger.Info("Server starting", "addr", ln.Addr().String())
+
+	select {
+	case err := <-served:
+		fatal("Server failed", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	logger.Info("Shutting down, draining requests", "timeout", cfg.HTTP.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+	if err := a.shutdown(shutdownCtx); err != nil {
+		fatal("Unclean shutdown", err)
+	}
+	logger.Info("Server stopped")
+}
+
+// app is the API server together with its database and background workers
+type app struct {
+	db            *gorm.DB
+	api           *handlers.Server
+	server        *http.Server
+	shutdownDelay time.Duration // see config.HTTP.ShutdownDelay
+
+	stopWorkers context.CancelFunc
+	workersDone chan struct{}
+}
+
+// newApp opens the database and starts the background workers. The server
+// is started by serve.
+func newApp(cfg config.Config, logger *slog.Logger) (*app, error) {
+	db, err := database.Open(cfg.Database, logger)
+	if err != nil {
+		return nil, err
+	}
+	m := metrics.New()
+	if err := m.InstrumentDB(db); err != nil {
+		return nil, err
+	}
+
+	// Deliver queued user changes to webhooks in the background
+	dispatcher := webhooks.NewDispatcher(db)
+	dispatcher.Logger = logger
+
+	api := handlers.NewServer(handlers.Deps{
+		DB:              db,
+		Validate:        validation.New(),
+		Logger:          logger,
+		Metrics:         m,
+		MaxBodyBytes:    cfg.HTTP.MaxBodyBytes,
+		RequestTimeout:  cfg.HTTP.RequestTimeout,
+		IdempotencyTTL:  cfg.HTTP.IdempotencyTTL,
+		ReadinessChecks: map[string]handlers.Check{"workers": dispatcher.Check},
+	})
+	a := &app{
+		db:            db,
+		api:           api,
+		shutdownDelay: cfg.HTTP.ShutdownDelay,
+		server: &http.Server{
+			Handler:           api.Router(),
+			ReadTimeout:       cfg.HTTP.ReadTimeout,
+			ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+			WriteTimeout:      cfg.HTTP.WriteTimeout,
+			IdleTimeout:       cfg.HTTP.IdleTimeout,
+			MaxHeaderBytes:    cfg.HTTP.MaxHeaderBytes,
+			ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		},
+		workersDone: make(chan struct{}),
+	}
+
+	var workers context.Context
+	workers, a.stopWorkers = context.WithCancel(context.Background())
+	go func() {
+		defer close(a.workersDone)
+		dispatcher.Run(workers)
+	}()
+
+	return a, nil
+}
+
+// serve handles requests on ln until shutdown is called
+func (a *app) serve(ln net.Listener) error {
+	if err := a.server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// shutdown stops the app in order, so that nothing is cut off while it
+// still has work to do:
+//
+// 1. fail readiness and keep serving for shutdownDelay, so that the
+// orchestrator stops routing new traffic here
+// 2. stop accepting connections, end event streams and WebSockets, and wait
+// for in-flight requests to finish
+// 3. stop the background workers, which may still deliver what the last
+// requests queued
+// 4. close the database
+//
+// Requests still running when ctx is done are cut off, and ctx's error is
+// returned after the remaining steps.
+func (a *app) shutdown(ctx context.Context) error {
+	a.api.BeginShutdown()
+	if a.shutdownDelay > 0 {
+		select {
+		case <-time.After(a.shutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- a.api.Drain(ctx) }()
+	err := a.server.Shutdown(ctx)
+	if drainErr := <-drained; err == nil {
+		err = drainErr
+	}
+	if err != nil {
+		a.server.Close()
+	}
+
+	a.stopWorkers()
+	<-a.workersDone
+
+	sqlDB, dbErr := a.db.DB()
+	if dbErr == nil {
+		dbErr = sqlDB.Close()
+	}
+	return errors.Join(err, dbErr)
 }
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"database/sql"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// startKey holds the start time of a statement in its GORM instance
+const startKey = "metrics:start"
+
+// InstrumentDB records the duration of every statement run through db in
+// QueryDuration and exposes the connection pool statistics of db. It may be
+// called once per Metrics.
+func (m *Metrics) InstrumentDB(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	// Before("*") and After("*") run first and last among the callbacks of
+	// an operation
+	callbacks := db.Callback()
+	type register func(string, func(*gorm.DB)) error
+	operations := []struct {
+		name          string
+		before, after register
+	}{
+		{"create", callbacks.Create().Before("*").Register, callbacks.Create().After("*").Register},
+		{"query", callbacks.Query().Before("*").Register, callbacks.Query().After("*").Register},
+		{"update", callbacks.Update().Before("*").Register, callbacks.Update().After("*").Register},
+		{"delete", callbacks.Delete().Before("*").Register, callbacks.Delete().After("*").Register},
+		{"row", callbacks.Row().Before("*").Register, callbacks.Row().After("*").Register},
+		{"raw", callbacks.Raw().Before("*").Register, callbacks.Raw().After("*").Register},
+	}
+	for _, op := range operations {
+		err := op.before("metrics:before_"+op.name, func(tx *gorm.DB) {
+			tx.InstanceSet(startKey, time.Now())
+		})
+		if err != nil {
+			return err
+		}
+		err = op.after("metrics:after_"+op.name, func(tx *gorm.DB) {
+			if start, ok := tx.InstanceGet(startKey); ok {
+				m.QueryDuration.Observe(time.Since(start.(time.Time)).Seconds(), op.name, tx.Statement.Table)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	stat := func(fn func(s sql.DBStats) float64) func() float64 {
+		return func() float64 { return fn(sqlDB.Stats()) }
+	}
+	r := m.Registry
+	r.GaugeFunc("db_max_open_connections", "Maximum number of open database connections.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	r.GaugeFunc("db_open_connections", "Open database connections, in use and idle.",
+		stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	r.GaugeFunc("db_in_use_connections", "Database connections in use.",
+		stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	r.GaugeFunc("db_idle_connections", "Idle database connections.",
+		stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	r.CounterFunc("db_wait_count_total", "Times a statement waited for a free database connection.",
+		stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	r.CounterFunc("db_wait_duration_seconds_total", "Time spent waiting for free database connections.",
+		stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	r.CounterFunc("db_max_idle_closed_total", "Connections closed because of the idle connection limit.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	r.CounterFunc("db_max_lifetime_closed_total", "Connections closed because they reached their maximum lifetime.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+	return nil
+}
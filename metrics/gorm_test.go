@@ -0,0 +1,55 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"golang-http-patch/metrics"
+	"golang-http-patch/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestInstrumentDB(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	if err := models.AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	m := metrics.New()
+	if err := m.InstrumentDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	user := models.User{Name: "Jane", Email: "jane@example.com", Age: 30}
+	db.Create(&user)
+	db.First(&models.User{}, user.ID)
+	db.First(&models.User{}, user.ID)
+	db.Model(&user).Update("age", 31)
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	db.Delete(&user)
+
+	for _, op := range []struct {
+		operation string
+		want      uint64
+	}{{"create", 1}, {"query", 3}, {"update", 1}, {"delete", 1}} {
+		if got := m.QueryDuration.Count(op.operation, "users"); got != op.want {
+			t.Errorf("Expected %d %s statements on users, got %d", op.want, op.operation, got)
+		}
+	}
+
+	var out strings.Builder
+	m.Registry.WriteTo(&out)
+	for _, line := range []string{"db_max_open_connections 1\n", "db_open_connections 1\n", "db_in_use_connections 0\n", "# TYPE db_wait_count_total counter\n"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"golang-http-patch/patch"
+)
+
+// Metrics are the metrics of the API, collected in one registry
+type Metrics struct {
+	Registry *Registry
+
+	// Requests and RequestDuration are labelled with method, route and status
+	Requests        *Counter
+	RequestDuration *Histogram
+	// QueryDuration is labelled with operation and table, see InstrumentDB
+	QueryDuration *Histogram
+	// ValidationFailures is labelled with field and tag
+	ValidationFailures *Counter
+	// PatchFields is labelled with field and state: unset, null or value
+	PatchFields *Counter
+}
+
+// New returns the metrics of the API in a new registry
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		Registry: r,
+		Requests: r.Counter("http_requests_total",
+			"HTTP requests answered, by method, route template and status.", "method", "route", "status"),
+		RequestDuration: r.Histogram("http_request_duration_seconds",
+			"Time taken to answer HTTP requests, by method, route template and status.", DefaultBuckets, "method", "route", "status"),
+		QueryDuration: r.Histogram("db_query_duration_seconds",
+			"Time taken by database statements, by GORM operation and table.", DefaultBuckets, "operation", "table"),
+		ValidationFailures: r.Counter("validation_failures_total",
+			"Failed validation rules of request bodies, by field and validation tag.", "field", "tag"),
+		PatchFields: r.Counter("patch_fields_total",
+			"Fields of user patches by state: unset, null or value.", "field", "state"),
+	}
+}
+
+// ObserveRequest records an answered request. route is the route template,
+// so that requests for different users share a series.
+func (m *Metrics) ObserveRequest(method, route string, status int, elapsed time.Duration) {
+	code := strconv.Itoa(status)
+	m.Requests.Inc(method, route, code)
+	m.RequestDuration.Observe(elapsed.Seconds(), method, route, code)
+}
+
+// ObservePatch records the state of every field of p, a patch DTO made of
+// patch.Optional fields
+func (m *Metrics) ObservePatch(p any) {
+	for field, state := range patch.States(p) {
+		m.PatchFields.Inc(field, state)
+	}
+}
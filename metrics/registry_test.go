@@ -0,0 +1,72 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"golang-http-patch/metrics"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := metrics.NewRegistry()
+	requests := r.Counter("requests_total", "Requests by route.", "route", "status")
+	latency := r.Histogram("latency_seconds", "Latency\nin seconds.", []float64{0.1, 1}, "route")
+	r.GaugeFunc("connections", "Open connections.", func() float64 { return 3 })
+
+	requests.Inc("/users", "200")
+	requests.Add(2, "/users", "200")
+	requests.Inc(`/a"b\c`, "500")
+	latency.Observe(0.05, "/users")
+	latency.Observe(0.1, "/users")
+	latency.Observe(0.5, "/users")
+	latency.Observe(7, "/users")
+
+	var out strings.Builder
+	n, err := r.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Requests by route.
+# TYPE requests_total counter
+requests_total{route="/a\"b\\c",status="500"} 1
+requests_total{route="/users",status="200"} 3
+# HELP latency_seconds Latency\nin seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/users",le="0.1"} 2
+latency_seconds_bucket{route="/users",le="1"} 3
+latency_seconds_bucket{route="/users",le="+Inf"} 4
+latency_seconds_sum{route="/users"} 7.65
+latency_seconds_count{route="/users"} 4
+# HELP connections Open connections.
+# TYPE connections gauge
+connections 3
+`
+	if out.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, out.String())
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("Expected %d bytes written, got %d", out.Len(), n)
+	}
+	if requests.Value("/users", "200") != 3 || requests.Value("/other", "200") != 0 || latency.Count("/users") != 4 {
+		t.Error("Expected the values to be readable")
+	}
+}
+
+func TestRegistry_Misuse(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := r.Counter("requests_total", "Requests.", "route")
+
+	for name, misuse := range map[string]func(){
+		"duplicate name":     func() { r.GaugeFunc("requests_total", "Again.", func() float64 { return 0 }) },
+		"wrong label values": func() { c.Inc("/users", "200") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected a panic")
+				}
+			}()
+			misuse()
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"golang-http-patch/patch"
+)
+
+// Operations recorded in the user history
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update" // PUT
+	OperationPatch  = "patch"
+	OperationDelete = "delete"
+	OperationRevert = "revert" // PATCH generated from an older version
+)
+
+// UserHistory is an audit record of a single change to a user. Versions are
+// numbered per user starting at 1 and are written in the same transaction as
+// the change they describe.
+type UserHistory struct {
+	ID        uint          `json:"id" gorm:"primaryKey"`
+	UserID    uint          `json:"user_id" gorm:"not null;uniqueIndex:idx_user_history_version"`
+	Version   uint          `json:"version" gorm:"not null;uniqueIndex:idx_user_history_version"`
+	Operation string        `json:"operation" gorm:"type:varchar(10);not null"`
+	Actor     string        `json:"actor" gorm:"type:varchar(100);not null"`
+	Diff      patch.Changes `json:"diff" gorm:"type:text;serializer:json"` // field-level before/after values
+	CreatedAt time.Time     `json:"created_at" gorm:"index"`
+}
+
+// TableName keeps the audit table name singular
+func (UserHistory) TableName() string {
+	return "user_history"
+}
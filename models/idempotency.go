@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// IdempotencyKey stores the outcome of a request sent with an Idempotency-Key
+// header so that retries of the same request can be answered without
+// executing it again
+type IdempotencyKey struct {
+	Key         string    `gorm:"primaryKey;type:varchar(255)"`
+	Fingerprint string    `gorm:"type:varchar(64);not null"` // sha256 of method, path, query, Prefer header and body
+	StatusCode  int       `gorm:"not null"`
+	Header      string    `gorm:"type:text"` // JSON-encoded response headers
+	Body        []byte    `gorm:"type:blob"`
+	CreatedAt   time.Time `gorm:"not null"`
+	ExpiresAt   time.Time `gorm:"index;not null"`
+}
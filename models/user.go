@@ -1,7 +1,10 @@
 package models
 
 import (
+	"fmt"
+
 	"golang-http-patch/patch"
+	"golang-http-patch/redact"
 
 	"gorm.io/gorm"
 )
@@ -10,15 +13,19 @@ import (
 type User struct {
 	ID     uint    `json:"id" gorm:"primaryKey"`
 	Name   string  `json:"name" gorm:"not null"`
-	Email  string  `json:"email" gorm:"uniqueIndex;not null"`
+	Email  string  `json:"email" gorm:"uniqueIndex;not null" redact:"email"`
 	Age    int     `json:"age" gorm:"not null"`
-	Phone  *string `json:"phone" gorm:"type:varchar(20)"` // nullable - can be null
+	Phone  *string `json:"phone" gorm:"type:varchar(20)" redact:"phone"` // nullable - can be null
 	Active bool    `json:"active" gorm:"default:true"`
 	Bio    string  `json:"bio" gorm:"type:text"`                        // optional text field
 	Role   string  `json:"role" gorm:"type:varchar(20);default:'user'"` // enum-like: admin, user, guest
 	Score  float64 `json:"score" gorm:"type:decimal(10,2);default:0"`   // numeric field
 }
 
+// UserRedaction masks the personal data of users, the fields tagged with
+// redact, in logs, audit output and error messages
+var UserRedaction = redact.For(User{})
+
 // DTOs for request validation
 type CreateUserDTO struct {
 	Name   string  `json:"name" validate:"required,min=2,max=100"`
@@ -39,15 +46,35 @@ type UpdateUserDTO struct {
 	Bio    string  `json:"bio" validate:"omitempty,max=500"`
 	Role   string  `json:"role" validate:"required,oneof=admin user guest"`
 	Score  float64 `json:"score" validate:"required,gte=0,lte=100"`
-	// Email is immutable and cannot be updated after creation
+	// Email is immutable: it is required to create a user via PUT and
+	// ignored when the user already exists
+	Email string `json:"email,omitempty" validate:"omitempty,email"`
+}
+
+// Patch returns the patch that replaces every mutable field with dto's values
+func (dto UpdateUserDTO) Patch() PatchUserDTO {
+	phone := patch.Null[string]()
+	if dto.Phone != nil {
+		phone = patch.Some(*dto.Phone)
+	}
+	return PatchUserDTO{
+		Name:   patch.Some(dto.Name),
+		Age:    patch.Some(dto.Age),
+		Phone:  phone,
+		Active: patch.Some(dto.Active),
+		Bio:    patch.Some(dto.Bio),
+		Role:   patch.Some(dto.Role),
+		Score:  patch.Some(dto.Score),
+	}
 }
 
 type PatchUserDTO struct {
-	// String field: can be unset (ignore), null (remove), or value (update)
-	Name patch.Optional[string] `json:"name" validate:"opt=min=2;max=100"`
+	// Required string field: can be unset (ignore) or value (update), but not
+	// null since the column is NOT NULL
+	Name patch.Optional[string] `json:"name" validate:"nonull,opt=min=2;max=100"`
 
-	// Numeric field: validate range only when present
-	Age patch.Optional[int] `json:"age" validate:"opt=gte=0;lte=150"`
+	// Required numeric field: validate range only when present, never null
+	Age patch.Optional[int] `json:"age" validate:"nonull,opt=gte=0;lte=150"`
 
 	// Nullable string field: can be unset (ignore), null (remove), or value (update)
 	Phone patch.Optional[string] `json:"phone" validate:"opt=min=10;max=20"`
@@ -66,7 +93,47 @@ type PatchUserDTO struct {
 	// Email is immutable and cannot be updated after creation
 }
 
-// AutoMigrate runs database migrations for User model
+// Updates builds the column updates map only for provided fields
+func (dto PatchUserDTO) Updates() map[string]interface{} {
+	updates := make(map[string]interface{})
+	patch.SetUpdate(updates, "name", dto.Name)
+	patch.SetUpdate(updates, "age", dto.Age)
+	patch.SetUpdate(updates, "phone", dto.Phone)
+	patch.SetUpdate(updates, "active", dto.Active)
+	patch.SetUpdate(updates, "bio", dto.Bio)
+	patch.SetUpdate(updates, "role", dto.Role)
+	patch.SetUpdate(updates, "score", dto.Score)
+	// Email is immutable and cannot be updated
+	return updates
+}
+
+// all lists every model, in migration order
+func all() []interface{} {
+	return []interface{}{&User{}, &IdempotencyKey{}, &UserHistory{}, &Webhook{}, &OutboxMessage{}, &WebhookDelivery{}}
+}
+
+// AutoMigrate runs database migrations for all models
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(&User{})
+	return db.AutoMigrate(all()...)
+}
+
+// CheckMigrations reports the first table or column of the models missing
+// from db, i.e. whether AutoMigrate has been run against it
+func CheckMigrations(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for _, model := range all() {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		if !migrator.HasTable(model) {
+			return fmt.Errorf("table %s is missing", stmt.Schema.Table)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !field.IgnoreMigration && !migrator.HasColumn(model, field.DBName) {
+				return fmt.Errorf("column %s.%s is missing", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"slices"
+	"time"
+
+	"golang-http-patch/patch"
+)
+
+// Webhook is a partner URL that is notified of user changes. Operations and
+// Fields narrow down which changes are sent; an empty list matches all.
+type Webhook struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	URL        string    `json:"url" gorm:"type:varchar(2048);not null"`
+	Secret     string    `json:"secret,omitempty" gorm:"type:varchar(255);not null"` // HMAC key, only returned on registration
+	Operations []string  `json:"operations" gorm:"type:text;serializer:json"`
+	Fields     []string  `json:"fields" gorm:"type:text;serializer:json"` // at least one of them must have changed
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Matches reports whether a change passes the webhook's filters
+func (h Webhook) Matches(operation string, changes patch.Changes) bool {
+	if len(h.Operations) > 0 && !slices.Contains(h.Operations, operation) {
+		return false
+	}
+	if len(h.Fields) == 0 {
+		return true
+	}
+	for _, field := range h.Fields {
+		if _, ok := changes[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateWebhookDTO is used for registering a webhook
+type CreateWebhookDTO struct {
+	URL        string   `json:"url" validate:"required,http_url,max=2048"`
+	Secret     string   `json:"secret" validate:"omitempty,min=16,max=255"` // generated when empty
+	Operations []string `json:"operations" validate:"omitempty,unique,dive,oneof=create update patch delete revert"`
+	Fields     []string `json:"fields" validate:"omitempty,unique,dive,oneof=name email age phone active bio role score"`
+}
+
+// OutboxMessage is a user change waiting to be handed to the webhook
+// dispatcher. It is written in the same transaction as the change, so that
+// every committed change is delivered and no rolled back one ever is.
+type OutboxMessage struct {
+	ID           uint       `gorm:"primaryKey"`
+	Event        string     `gorm:"type:varchar(10);not null"` // the history operation
+	Payload      []byte     `gorm:"type:blob;not null"`        // JSON-encoded history entry
+	CreatedAt    time.Time  `gorm:"not null"`
+	DispatchedAt *time.Time `gorm:"index"` // set once deliveries have been created
+}
+
+// TableName keeps the outbox table name singular
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead" // gave up after the maximum number of attempts
+)
+
+// WebhookDelivery tracks sending one outbox message to one webhook
+type WebhookDelivery struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	WebhookID     uint       `json:"webhook_id" gorm:"not null;index"`
+	OutboxID      uint       `json:"outbox_id" gorm:"not null"`
+	Event         string     `json:"event" gorm:"type:varchar(10);not null"`
+	Status        string     `json:"status" gorm:"type:varchar(10);not null;index:idx_webhook_deliveries_due"`
+	Attempts      int        `json:"attempts" gorm:"not null"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"not null;index:idx_webhook_deliveries_due"`
+	LastError     string     `json:"last_error,omitempty" gorm:"type:varchar(500)"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
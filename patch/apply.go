@@ -0,0 +1,68 @@
+package patch
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Apply copies every set Optional field of src onto the field with the same
+// name in dst, which must be a pointer to a struct.
+//
+// - unset => dst field left untouched
+// - null  => dst field set to its zero value (nil for pointer fields)
+// - value => dst field set to the value (a new pointer for pointer fields)
+func Apply(dst any, src any) error {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("patch: destination must be a pointer to a struct, got %T", dst)
+	}
+	dv = dv.Elem()
+
+	sv := reflect.Indirect(reflect.ValueOf(src))
+	if sv.Kind() != reflect.Struct {
+		return fmt.Errorf("patch: source must be a struct, got %T", src)
+	}
+
+	for i := 0; i < sv.NumField(); i++ {
+		if !sv.Type().Field(i).IsExported() {
+			continue
+		}
+		oa, ok := sv.Field(i).Interface().(OptionalAny)
+		if !ok || !oa.IsSet() {
+			continue
+		}
+
+		name := sv.Type().Field(i).Name
+		target := dv.FieldByName(name)
+		if !target.IsValid() || !target.CanSet() {
+			return fmt.Errorf("patch: %s has no settable field %s", dv.Type(), name)
+		}
+
+		if oa.IsNull() {
+			target.Set(reflect.Zero(target.Type()))
+			continue
+		}
+		val, _ := oa.Any()
+		if err := assign(target, reflect.ValueOf(val)); err != nil {
+			return fmt.Errorf("patch: field %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// assign sets target to val, allocating a pointer when target is one
+func assign(target reflect.Value, val reflect.Value) error {
+	if target.Kind() == reflect.Ptr {
+		elem := reflect.New(target.Type().Elem())
+		if err := assign(elem.Elem(), val); err != nil {
+			return err
+		}
+		target.Set(elem)
+		return nil
+	}
+	if !val.Type().ConvertibleTo(target.Type()) {
+		return fmt.Errorf("cannot assign %s to %s", val.Type(), target.Type())
+	}
+	target.Set(val.Convert(target.Type()))
+	return nil
+}
@@ -0,0 +1,38 @@
+package patch
+
+import "reflect"
+
+// Compose squashes a sequence of Optional-based patches into one patch with
+// the same effect as applying them in order. For every field the last patch
+// that sets it wins:
+//
+// - unset then unset => unset
+// - any   then null  => null
+// - any   then value => value
+// - set   then unset => the earlier null or value
+//
+// Non-Optional fields are taken from the last patch.
+func Compose[P any](patches ...P) P {
+	var composed P
+	cv := reflect.ValueOf(&composed).Elem()
+	if cv.Kind() != reflect.Struct {
+		if len(patches) > 0 {
+			return patches[len(patches)-1]
+		}
+		return composed
+	}
+
+	for _, p := range patches {
+		pv := reflect.ValueOf(p)
+		for i := 0; i < pv.NumField(); i++ {
+			if !pv.Type().Field(i).IsExported() {
+				continue
+			}
+			if oa, ok := pv.Field(i).Interface().(OptionalAny); ok && !oa.IsSet() {
+				continue
+			}
+			cv.Field(i).Set(pv.Field(i))
+		}
+	}
+	return composed
+}
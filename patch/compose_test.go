@@ -0,0 +1,81 @@
+package patch_test
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+)
+
+func TestCompose_EqualsSequentialApply(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+
+	for run := 0; run < propertyRuns; run++ {
+		original := randomUser(rng)
+		patches := make([]models.PatchUserDTO, 1+rng.Intn(4))
+		for i := range patches {
+			patches[i] = randomPatch(rng)
+		}
+
+		sequential := original
+		for i, p := range patches {
+			if err := patch.Apply(&sequential, p); err != nil {
+				t.Fatalf("run %d: Apply(patch %d) failed: %v", run, i, err)
+			}
+		}
+
+		composed := original
+		if err := patch.Apply(&composed, patch.Compose(patches...)); err != nil {
+			t.Fatalf("run %d: Apply(composed) failed: %v", run, err)
+		}
+
+		if !reflect.DeepEqual(composed, sequential) {
+			t.Fatalf("run %d: composed patch differs from applying in order\npatches: %+v\nsequential: %+v\ncomposed: %+v",
+				run, patches, sequential, composed)
+		}
+	}
+}
+
+func TestCompose_Associative(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+
+	for run := 0; run < propertyRuns; run++ {
+		a, b, c := randomPatch(rng), randomPatch(rng), randomPatch(rng)
+
+		left := patch.Compose(patch.Compose(a, b), c)
+		right := patch.Compose(a, patch.Compose(b, c))
+		if !reflect.DeepEqual(left, right) {
+			t.Fatalf("run %d: compose is not associative\nleft: %+v\nright: %+v", run, left, right)
+		}
+	}
+}
+
+func TestCompose_Semantics(t *testing.T) {
+	composed := patch.Compose(
+		models.PatchUserDTO{Name: patch.Some("First"), Phone: patch.Some("1234567890"), Bio: patch.Null[string](), Age: patch.Some(20)},
+		models.PatchUserDTO{Name: patch.Some("Second"), Phone: patch.Null[string](), Bio: patch.Some("Back")},
+		models.PatchUserDTO{},
+	)
+
+	if v, _ := composed.Name.Value(); v != "Second" {
+		t.Errorf("Expected later value to win, got %s", composed.Name)
+	}
+	if !composed.Phone.IsNull() {
+		t.Errorf("Expected null after value to be null, got %s", composed.Phone)
+	}
+	if v, _ := composed.Bio.Value(); v != "Back" {
+		t.Errorf("Expected value after null to be the value, got %s", composed.Bio)
+	}
+	if v, _ := composed.Age.Value(); v != 20 {
+		t.Errorf("Expected unset to keep the earlier value, got %s", composed.Age)
+	}
+	if composed.Role.IsSet() {
+		t.Errorf("Expected field unset in every patch to stay unset, got %s", composed.Role)
+	}
+
+	if empty := patch.Compose[models.PatchUserDTO](); !reflect.DeepEqual(empty, models.PatchUserDTO{}) {
+		t.Errorf("Expected composing nothing to give an empty patch, got %+v", empty)
+	}
+}
@@ -0,0 +1,111 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change holds the before and after value of a single field
+type Change struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// Changes maps JSON field names to the values that changed
+type Changes map[string]Change
+
+// Diff compares two structs of the same type field by field and returns the
+// fields whose values differ, keyed by their JSON name. Pointer fields are
+// compared by the value they point to, with nil reported as null.
+func Diff(before, after any) Changes {
+	changes := Changes{}
+
+	bv := reflect.Indirect(reflect.ValueOf(before))
+	av := reflect.Indirect(reflect.ValueOf(after))
+	if bv.Kind() != reflect.Struct || bv.Type() != av.Type() {
+		return changes
+	}
+
+	for i := 0; i < bv.NumField(); i++ {
+		field := bv.Type().Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		from, to := plain(bv.Field(i)), plain(av.Field(i))
+		if !reflect.DeepEqual(from, to) {
+			changes[name] = Change{From: from, To: to}
+		}
+	}
+	return changes
+}
+
+// Empty reports whether no field changed
+func (c Changes) Empty() bool { return len(c) == 0 }
+
+// Fields returns the names of the changed fields in sorted order
+func (c Changes) Fields() []string {
+	fields := make([]string, 0, len(c))
+	for name := range c {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Reverse returns the changes that undo c, with every from and to swapped
+func (c Changes) Reverse() Changes {
+	reversed := make(Changes, len(c))
+	for name, change := range c {
+		reversed[name] = Change{From: change.To, To: change.From}
+	}
+	return reversed
+}
+
+// MergePatch returns a JSON Merge Patch (RFC 7396) style document that sets
+// every changed field to its new value, with null for removed values
+func (c Changes) MergePatch() map[string]any {
+	doc := make(map[string]any, len(c))
+	for name, change := range c {
+		doc[name] = change.To
+	}
+	return doc
+}
+
+// ApplyTo sets the fields of dst, a pointer to a struct, to the new values in
+// c by decoding the merge patch into it
+func (c Changes) ApplyTo(dst any) error {
+	b, err := json.Marshal(c.MergePatch())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// jsonName returns the JSON name of an exported struct field
+func jsonName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
+
+// plain dereferences pointers so that values can be compared and encoded
+func plain(v reflect.Value) any {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface()
+}
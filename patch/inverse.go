@@ -0,0 +1,51 @@
+package patch
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Inverse returns the patch that undoes p, given pre, the value p is applied
+// to. Every field set in p is set in the inverse to its prior value in pre
+// (null when that is a nil pointer); unset fields stay unset. Applying p and
+// then the inverse to pre yields pre again.
+func Inverse[P any](p P, pre any) (P, error) {
+	var inverse P
+
+	iv := reflect.ValueOf(&inverse).Elem()
+	if iv.Kind() != reflect.Struct {
+		return inverse, fmt.Errorf("patch: patch must be a struct, got %T", p)
+	}
+	pv := reflect.ValueOf(p)
+	prev := reflect.Indirect(reflect.ValueOf(pre))
+	if prev.Kind() != reflect.Struct {
+		return inverse, fmt.Errorf("patch: pre-image must be a struct, got %T", pre)
+	}
+
+	for i := 0; i < pv.NumField(); i++ {
+		if !pv.Type().Field(i).IsExported() {
+			continue
+		}
+		oa, ok := pv.Field(i).Interface().(OptionalAny)
+		if !ok || !oa.IsSet() {
+			continue
+		}
+
+		name := pv.Type().Field(i).Name
+		prior := prev.FieldByName(name)
+		if !prior.IsValid() {
+			return inverse, fmt.Errorf("patch: %s has no field %s", prev.Type(), name)
+		}
+
+		setter := iv.Field(i).Addr().Interface().(optionalSetter)
+		value := plain(prior)
+		if value == nil {
+			setter.setNull()
+			continue
+		}
+		if err := setter.setAny(value); err != nil {
+			return inverse, fmt.Errorf("patch: field %s: %w", name, err)
+		}
+	}
+	return inverse, nil
+}
@@ -0,0 +1,371 @@
+package patch_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+)
+
+const propertyRuns = 500
+
+func TestInverse_PatchUserDTO(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for run := 0; run < propertyRuns; run++ {
+		original := randomUser(rng)
+		p := randomPatch(rng)
+
+		inverse, err := patch.Inverse(p, original)
+		if err != nil {
+			t.Fatalf("run %d: Inverse failed: %v", run, err)
+		}
+
+		user := original
+		if err := patch.Apply(&user, p); err != nil {
+			t.Fatalf("run %d: Apply(patch) failed: %v", run, err)
+		}
+		if err := patch.Apply(&user, inverse); err != nil {
+			t.Fatalf("run %d: Apply(inverse) failed: %v", run, err)
+		}
+
+		if !reflect.DeepEqual(user, original) {
+			t.Fatalf("run %d: apply(patch) then apply(inverse) changed the user\noriginal: %+v\npatch: %+v\ninverse: %+v\ngot: %+v",
+				run, original, p, inverse, user)
+		}
+	}
+}
+
+func TestInverse_OnlySetFields(t *testing.T) {
+	phone := "1234567890"
+	user := models.User{Name: "Before", Phone: &phone, Bio: "Bio"}
+
+	inverse, err := patch.Inverse(models.PatchUserDTO{
+		Name:  patch.Some("After"),
+		Phone: patch.Null[string](),
+	}, user)
+	if err != nil {
+		t.Fatalf("Inverse failed: %v", err)
+	}
+
+	if v, ok := inverse.Name.Value(); !ok || v != "Before" {
+		t.Errorf("Expected name to be restored to Before, got %s", inverse.Name)
+	}
+	if v, ok := inverse.Phone.Value(); !ok || v != phone {
+		t.Errorf("Expected phone to be restored to %s, got %s", phone, inverse.Phone)
+	}
+	if inverse.Bio.IsSet() || inverse.Age.IsSet() {
+		t.Errorf("Expected fields missing from the patch to stay unset, got bio %s and age %s", inverse.Bio, inverse.Age)
+	}
+
+	// A nil pointer in the pre-image becomes null in the inverse
+	user.Phone = nil
+	inverse, _ = patch.Inverse(models.PatchUserDTO{Phone: patch.Some("0987654321")}, user)
+	if !inverse.Phone.IsNull() {
+		t.Errorf("Expected phone to be restored to null, got %s", inverse.Phone)
+	}
+}
+
+func TestInvertMergePatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	for run := 0; run < propertyRuns; run++ {
+		doc := mustMarshal(t, randomObject(rng, 3))
+		p := mustMarshal(t, randomMergePatch(rng, 3))
+
+		inverse, err := patch.InvertMergePatch(doc, p)
+		if err != nil {
+			t.Fatalf("run %d: InvertMergePatch failed: %v", run, err)
+		}
+		patched, err := patch.ApplyMergePatch(doc, p)
+		if err != nil {
+			t.Fatalf("run %d: ApplyMergePatch(patch) failed: %v", run, err)
+		}
+		restored, err := patch.ApplyMergePatch(patched, inverse)
+		if err != nil {
+			t.Fatalf("run %d: ApplyMergePatch(inverse) failed: %v", run, err)
+		}
+
+		assertSameJSON(t, fmt.Sprintf("run %d: doc %s, patch %s, inverse %s", run, doc, p, inverse), doc, restored)
+	}
+}
+
+func TestInvertJSONPatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+
+	for run := 0; run < propertyRuns; run++ {
+		doc := mustMarshal(t, randomObject(rng, 3))
+		ops := randomOperations(t, rng, doc, 1+rng.Intn(5))
+
+		inverse, err := patch.InvertJSONPatch(doc, ops)
+		if err != nil {
+			t.Fatalf("run %d: InvertJSONPatch failed: %v", run, err)
+		}
+		patched, err := patch.ApplyJSONPatch(doc, ops)
+		if err != nil {
+			t.Fatalf("run %d: ApplyJSONPatch(patch) failed: %v", run, err)
+		}
+		restored, err := patch.ApplyJSONPatch(patched, inverse)
+		if err != nil {
+			t.Fatalf("run %d: ApplyJSONPatch(inverse %s) failed: %v", run, mustMarshal(t, inverse), err)
+		}
+
+		assertSameJSON(t, fmt.Sprintf("run %d: doc %s, patch %s, inverse %s", run, doc, mustMarshal(t, ops), mustMarshal(t, inverse)), doc, restored)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	doc := []byte(`{"name": "John", "tags": ["a", "b"], "address": {"city": "Paris"}}`)
+	ops := []patch.Operation{
+		{Op: "test", Path: "/name", Value: "John"},
+		{Op: "replace", Path: "/name", Value: "Jane"},
+		{Op: "add", Path: "/tags/1", Value: "x"},
+		{Op: "add", Path: "/tags/-", Value: "z"},
+		{Op: "remove", Path: "/tags/0"},
+		{Op: "move", From: "/address/city", Path: "/city"},
+		{Op: "copy", From: "/city", Path: "/address/town"},
+		{Op: "add", Path: "/phone", Value: nil},
+	}
+
+	got, err := patch.ApplyJSONPatch(doc, ops)
+	if err != nil {
+		t.Fatalf("ApplyJSONPatch failed: %v", err)
+	}
+	assertSameJSON(t, "apply", []byte(`{"name": "Jane", "tags": ["x", "b", "z"], "address": {"town": "Paris"}, "city": "Paris", "phone": null}`), got)
+
+	if _, err := patch.ApplyJSONPatch(doc, []patch.Operation{{Op: "test", Path: "/name", Value: "Jane"}}); err != patch.ErrTestFailed {
+		t.Errorf("Expected ErrTestFailed, got %v", err)
+	}
+	if _, err := patch.ApplyJSONPatch(doc, []patch.Operation{{Op: "remove", Path: "/missing"}}); err == nil {
+		t.Error("Expected an error removing a missing member")
+	}
+}
+
+func randomUser(rng *rand.Rand) models.User {
+	user := models.User{
+		ID:     uint(rng.Intn(1000) + 1),
+		Name:   randomString(rng),
+		Email:  randomString(rng) + "@example.com",
+		Age:    rng.Intn(150),
+		Active: rng.Intn(2) == 0,
+		Bio:    randomString(rng),
+		Role:   []string{"admin", "user", "guest", ""}[rng.Intn(4)],
+		Score:  float64(rng.Intn(10000)) / 100,
+	}
+	if rng.Intn(2) == 0 {
+		phone := randomString(rng)
+		user.Phone = &phone
+	}
+	return user
+}
+
+func randomPatch(rng *rand.Rand) models.PatchUserDTO {
+	return models.PatchUserDTO{
+		Name:   randomOptional(rng, randomString),
+		Age:    randomOptional(rng, func(rng *rand.Rand) int { return rng.Intn(150) }),
+		Phone:  randomOptional(rng, randomString),
+		Active: randomOptional(rng, func(rng *rand.Rand) bool { return rng.Intn(2) == 0 }),
+		Bio:    randomOptional(rng, randomString),
+		Role:   randomOptional(rng, func(rng *rand.Rand) string { return []string{"admin", "user", "guest"}[rng.Intn(3)] }),
+		Score:  randomOptional(rng, func(rng *rand.Rand) float64 { return float64(rng.Intn(10000)) / 100 }),
+	}
+}
+
+// randomOptional returns an unset, null or value Optional with equal odds
+func randomOptional[T any](rng *rand.Rand, value func(*rand.Rand) T) patch.Optional[T] {
+	switch rng.Intn(3) {
+	case 0:
+		return patch.Optional[T]{}
+	case 1:
+		return patch.Null[T]()
+	default:
+		return patch.Some(value(rng))
+	}
+}
+
+func randomString(rng *rand.Rand) string {
+	return []string{"", "a", "b", "hello", "world", "x/y", "~tilde"}[rng.Intn(7)]
+}
+
+// randomObject returns a JSON object without nulls, which merge patches
+// cannot restore
+func randomObject(rng *rand.Rand, depth int) map[string]any {
+	obj := make(map[string]any)
+	for i := rng.Intn(4); i >= 0; i-- {
+		obj[randomKey(rng)] = randomValue(rng, depth-1)
+	}
+	return obj
+}
+
+func randomValue(rng *rand.Rand, depth int) any {
+	kind := rng.Intn(6)
+	if depth <= 0 {
+		kind = rng.Intn(4)
+	}
+	switch kind {
+	case 0:
+		return randomString(rng)
+	case 1:
+		return float64(rng.Intn(100))
+	case 2:
+		return rng.Intn(2) == 0
+	case 3:
+		return randomString(rng) + "!"
+	case 4:
+		arr := make([]any, rng.Intn(4))
+		for i := range arr {
+			arr[i] = randomValue(rng, depth-1)
+		}
+		return arr
+	default:
+		return randomObject(rng, depth)
+	}
+}
+
+func randomMergePatch(rng *rand.Rand, depth int) map[string]any {
+	p := make(map[string]any)
+	for i := rng.Intn(4); i >= 0; i-- {
+		switch rng.Intn(3) {
+		case 0:
+			p[randomKey(rng)] = nil
+		case 1:
+			if depth > 1 {
+				p[randomKey(rng)] = randomMergePatch(rng, depth-1)
+				continue
+			}
+			fallthrough
+		default:
+			p[randomKey(rng)] = randomValue(rng, depth-1)
+		}
+	}
+	return p
+}
+
+func randomKey(rng *rand.Rand) string {
+	return []string{"a", "b", "c", "d", "e/f", "g~h"}[rng.Intn(6)]
+}
+
+// randomOperations builds n operations that are each valid against the
+// document produced by the operations before them
+func randomOperations(t *testing.T, rng *rand.Rand, doc []byte, n int) []patch.Operation {
+	var ops []patch.Operation
+	for len(ops) < n {
+		var cur any
+		json.Unmarshal(doc, &cur)
+		paths := pointers(cur, "")
+		path := paths[rng.Intn(len(paths))]
+
+		var op patch.Operation
+		switch rng.Intn(6) {
+		case 0:
+			op = patch.Operation{Op: "add", Path: childPointer(rng, cur, paths), Value: randomValue(rng, 2)}
+		case 1:
+			op = patch.Operation{Op: "remove", Path: path}
+		case 2:
+			op = patch.Operation{Op: "replace", Path: path, Value: randomValue(rng, 2)}
+		case 3:
+			op = patch.Operation{Op: "move", From: path, Path: childPointer(rng, cur, paths)}
+		case 4:
+			op = patch.Operation{Op: "copy", From: path, Path: childPointer(rng, cur, paths)}
+		default:
+			value, _ := json.Marshal(lookup(cur, path))
+			var decoded any
+			json.Unmarshal(value, &decoded)
+			op = patch.Operation{Op: "test", Path: path, Value: decoded}
+		}
+
+		next, err := patch.ApplyJSONPatch(doc, []patch.Operation{op})
+		if err != nil {
+			// Invalid for this document (e.g. removing the root), try another
+			continue
+		}
+		ops = append(ops, op)
+		doc = next
+	}
+	return ops
+}
+
+// pointers lists the JSON pointer of every value in doc, including the root
+func pointers(doc any, prefix string) []string {
+	paths := []string{prefix}
+	switch node := doc.(type) {
+	case map[string]any:
+		for key, value := range node {
+			paths = append(paths, pointers(value, prefix+"/"+escape(key))...)
+		}
+	case []any:
+		for i, value := range node {
+			paths = append(paths, pointers(value, fmt.Sprintf("%s/%d", prefix, i))...)
+		}
+	}
+	return paths
+}
+
+// childPointer picks a location that an add could target, falling back to
+// the root when the document has no containers
+func childPointer(rng *rand.Rand, doc any, paths []string) string {
+	for attempt := 0; attempt < 10; attempt++ {
+		parent := paths[rng.Intn(len(paths))]
+		switch node := lookup(doc, parent).(type) {
+		case map[string]any:
+			return parent + "/" + escape(randomKey(rng))
+		case []any:
+			if rng.Intn(3) == 0 {
+				return parent + "/-"
+			}
+			return fmt.Sprintf("%s/%d", parent, rng.Intn(len(node)+1))
+		}
+	}
+	return ""
+}
+
+func lookup(doc any, pointer string) any {
+	if pointer == "" {
+		return doc
+	}
+	cur := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch node := cur.(type) {
+		case map[string]any:
+			cur = node[token]
+		case []any:
+			var i int
+			fmt.Sscan(token, &i)
+			cur = node[i]
+		}
+	}
+	return cur
+}
+
+func escape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to marshal %v: %v", v, err)
+	}
+	return b
+}
+
+func assertSameJSON(t *testing.T, context string, expected, got []byte) {
+	t.Helper()
+	var e, g any
+	if err := json.Unmarshal(expected, &e); err != nil {
+		t.Fatalf("%s: invalid expected JSON: %v", context, err)
+	}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("%s: invalid JSON result: %v", context, err)
+	}
+	if !reflect.DeepEqual(e, g) {
+		t.Fatalf("%s: expected %s, got %s", context, expected, got)
+	}
+}
@@ -0,0 +1,396 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Operation is a single JSON Patch (RFC 6902) operation
+type Operation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// MarshalJSON always includes the value of add, replace and test operations,
+// even when it is null
+func (op Operation) MarshalJSON() ([]byte, error) {
+	type plainOperation Operation
+	if op.Op != "add" && op.Op != "replace" && op.Op != "test" {
+		return json.Marshal(plainOperation(op))
+	}
+	return json.Marshal(struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value any    `json:"value"`
+	}{op.Op, op.Path, op.Value})
+}
+
+// ErrTestFailed is returned when a test operation does not match
+var ErrTestFailed = errors.New("patch: test operation failed")
+
+// ApplyJSONPatch applies the JSON Patch operations to doc in order
+func ApplyJSONPatch(doc []byte, ops []Operation) ([]byte, error) {
+	cur, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		if cur, err = applyOperation(cur, op); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(cur)
+}
+
+// InvertJSONPatch returns the operations that restore doc after ops have been
+// applied to it. Test operations have no effect and are not inverted.
+func InvertJSONPatch(doc []byte, ops []Operation) ([]Operation, error) {
+	cur, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	inverse := []Operation{}
+	for _, op := range ops {
+		next, err := applyOperation(deepCopy(cur), op)
+		if err != nil {
+			return nil, err
+		}
+		undo, err := invertOperation(cur, next, op)
+		if err != nil {
+			return nil, err
+		}
+		// Later operations are undone first
+		inverse = append(undo, inverse...)
+		cur = next
+	}
+	return inverse, nil
+}
+
+func applyOperation(doc any, op Operation) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, deepCopy(op.Value))
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		if _, err := getValue(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return deepCopy(op.Value), nil
+		}
+		return modify(doc, path, func(parent any, key string) (any, error) {
+			switch p := parent.(type) {
+			case map[string]any:
+				p[key] = deepCopy(op.Value)
+				return p, nil
+			case []any:
+				i, err := arrayIndex(key, len(p)-1)
+				if err != nil {
+					return nil, err
+				}
+				p[i] = deepCopy(op.Value)
+				return p, nil
+			}
+			return nil, fmt.Errorf("patch: cannot replace in %T", parent)
+		})
+	case "move":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.From == op.Path {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("patch: cannot move %q into itself", op.From)
+		}
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(value))
+	case "test":
+		value, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, normalize(op.Value)) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("patch: unknown operation %q", op.Op)
+}
+
+// invertOperation returns the operations that turn after back into before,
+// where after is the result of applying op to before
+func invertOperation(before, after any, op Operation) ([]Operation, error) {
+	switch op.Op {
+	case "add", "copy":
+		return undoAdd(before, after, op.Path)
+	case "remove", "replace":
+		path, _ := parsePointer(op.Path)
+		prior, err := getValue(before, path)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "remove" {
+			return []Operation{{Op: "add", Path: op.Path, Value: deepCopy(prior)}}, nil
+		}
+		return []Operation{{Op: "replace", Path: op.Path, Value: deepCopy(prior)}}, nil
+	case "move":
+		if op.From == op.Path {
+			return nil, nil
+		}
+		// Undo the add into the document that lacked the value at from, then
+		// put the value back where it came from
+		from, _ := parsePointer(op.From)
+		intermediate, value, err := removeValue(deepCopy(before), from)
+		if err != nil {
+			return nil, err
+		}
+		undo, err := undoAdd(intermediate, after, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return append(undo, Operation{Op: "add", Path: op.From, Value: value}), nil
+	case "test":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("patch: unknown operation %q", op.Op)
+}
+
+// undoAdd returns the operation that undoes adding a value at pointer
+func undoAdd(before, after any, pointer string) ([]Operation, error) {
+	path, _ := parsePointer(pointer)
+	if len(path) == 0 {
+		return []Operation{{Op: "replace", Path: "", Value: deepCopy(before)}}, nil
+	}
+
+	parent, err := getValue(before, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	if obj, ok := parent.(map[string]any); ok {
+		if prior, existed := obj[path[len(path)-1]]; existed {
+			return []Operation{{Op: "replace", Path: pointer, Value: deepCopy(prior)}}, nil
+		}
+	}
+	return []Operation{{Op: "remove", Path: resolvePointer(after, path)}}, nil
+}
+
+// resolvePointer formats path, replacing a trailing "-" array index with the
+// index of the last element of that array in doc
+func resolvePointer(doc any, path []string) string {
+	if len(path) > 0 && path[len(path)-1] == "-" {
+		if parent, err := getValue(doc, path[:len(path)-1]); err == nil {
+			if arr, ok := parent.([]any); ok {
+				path = append(append([]string{}, path[:len(path)-1]...), strconv.Itoa(len(arr)-1))
+			}
+		}
+	}
+	return formatPointer(path)
+}
+
+func getValue(doc any, path []string) (any, error) {
+	cur := doc
+	for _, token := range path {
+		switch node := cur.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("patch: path %q does not exist", formatPointer(path))
+			}
+			cur = value
+		case []any:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			cur = node[i]
+		default:
+			return nil, fmt.Errorf("patch: path %q does not exist", formatPointer(path))
+		}
+	}
+	return cur, nil
+}
+
+func addValue(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return modify(doc, path, func(parent any, key string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[key] = value
+			return p, nil
+		case []any:
+			if key == "-" {
+				return append(p, value), nil
+			}
+			i, err := arrayIndex(key, len(p))
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("patch: cannot add to %T", parent)
+	})
+}
+
+func removeValue(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("patch: cannot remove the whole document")
+	}
+	var removed any
+	doc, err := modify(doc, path, func(parent any, key string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			value, ok := p[key]
+			if !ok {
+				return nil, fmt.Errorf("patch: path %q does not exist", formatPointer(path))
+			}
+			removed = value
+			delete(p, key)
+			return p, nil
+		case []any:
+			i, err := arrayIndex(key, len(p)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("patch: cannot remove from %T", parent)
+	})
+	return doc, removed, err
+}
+
+// modify walks to the parent of the last path token and replaces it with the
+// result of fn, so that arrays can grow and shrink
+func modify(node any, path []string, fn func(parent any, key string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("patch: path %q does not exist", formatPointer(path))
+		}
+		updated, err := modify(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = updated
+		return n, nil
+	case []any:
+		i, err := arrayIndex(path[0], len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := modify(n[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = updated
+		return n, nil
+	}
+	return nil, fmt.Errorf("patch: path %q does not exist", formatPointer(path))
+}
+
+// arrayIndex parses an array index token that must not exceed max
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("patch: invalid array index %q", token)
+	}
+	return i, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("patch: invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func formatPointer(path []string) string {
+	var b strings.Builder
+	for _, token := range path {
+		b.WriteString("/")
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// deepCopy copies decoded JSON values so that documents never share state
+func deepCopy(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(value))
+		for k, item := range value {
+			c[k] = deepCopy(item)
+		}
+		return c
+	case []any:
+		c := make([]any, len(value))
+		for i, item := range value {
+			c[i] = deepCopy(item)
+		}
+		return c
+	}
+	return normalize(v)
+}
+
+// normalize converts values built in Go (e.g. ints) to their decoded JSON form
+func normalize(v any) any {
+	switch v.(type) {
+	case nil, bool, string, float64, map[string]any, []any:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var decoded any
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return v
+	}
+	return decoded
+}
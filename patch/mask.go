@@ -0,0 +1,70 @@
+package patch
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ParseMask splits a comma-separated field mask such as "name,phone" into
+// its paths
+func ParseMask(s string) []string {
+	var paths []string
+	for _, path := range strings.Split(s, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// ApplyMask turns a patch decoded from a full object into a patch with
+// FieldMask semantics, where only the fields named in mask are updated:
+//
+// - in the mask and set   => left as is (value or null)
+// - in the mask and unset => null, so that the field is cleared
+// - not in the mask       => unset, whatever the object contained
+//
+// dst must be a pointer to a struct of Optional fields. Paths are matched
+// against the JSON field names; any path without a matching Optional field is
+// reported as an error and dst is left untouched.
+func ApplyMask(dst any, mask []string) error {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("patch: destination must be a pointer to a struct, got %T", dst)
+	}
+	dv = dv.Elem()
+
+	fields := make(map[string]optionalSetter)
+	for i := 0; i < dv.NumField(); i++ {
+		name, ok := jsonName(dv.Type().Field(i))
+		if !ok {
+			continue
+		}
+		if setter, ok := dv.Field(i).Addr().Interface().(optionalSetter); ok {
+			fields[name] = setter
+		}
+	}
+
+	masked := make(map[string]bool, len(mask))
+	var unknown []string
+	for _, path := range mask {
+		if _, ok := fields[path]; !ok {
+			unknown = append(unknown, path)
+		}
+		masked[path] = true
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("patch: unknown field mask paths: %s", strings.Join(unknown, ", "))
+	}
+
+	for name, setter := range fields {
+		switch {
+		case !masked[name]:
+			setter.unset()
+		case !setter.(OptionalAny).IsSet():
+			setter.setNull()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package patch_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+)
+
+func TestApplyMask(t *testing.T) {
+	var dto models.PatchUserDTO
+	body := `{"id": 7, "name": "Jane", "email": "jane@example.com", "age": 30, "bio": null, "role": "admin"}`
+	if err := json.Unmarshal([]byte(body), &dto); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := patch.ApplyMask(&dto, patch.ParseMask(" name, phone ,bio")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := models.PatchUserDTO{
+		Name:  patch.Some("Jane"),
+		Phone: patch.Null[string](), // in the mask but missing from the body
+		Bio:   patch.Null[string](),
+	}
+	if !reflect.DeepEqual(dto, expected) {
+		t.Errorf("expected %v, got %v", expected, dto)
+	}
+}
+
+func TestApplyMask_UnknownPaths(t *testing.T) {
+	dto := models.PatchUserDTO{Name: patch.Some("Jane")}
+
+	err := patch.ApplyMask(&dto, []string{"name", "email", "nickname"})
+	if err == nil || err.Error() != "patch: unknown field mask paths: email, nickname" {
+		t.Fatalf("expected unknown path error, got %v", err)
+	}
+	if !reflect.DeepEqual(dto, models.PatchUserDTO{Name: patch.Some("Jane")}) {
+		t.Errorf("expected patch to be left untouched, got %v", dto)
+	}
+}
@@ -0,0 +1,49 @@
+package patch
+
+import "reflect"
+
+// Conflict is a field that both sides changed from the base to different values
+type Conflict struct {
+	Field  string `json:"field"`
+	Base   any    `json:"base"`
+	Ours   any    `json:"ours"`
+	Theirs any    `json:"theirs"`
+}
+
+// Merge3 performs a three-way merge of two structs that were both derived from
+// base. Field by field:
+//
+// - only ours changed   => ours
+// - only theirs changed => theirs
+// - both changed alike  => that value
+// - both changed differently => conflict, ours is kept
+//
+// The merged value is only meaningful when no conflicts are returned.
+// Conflicting fields are reported by JSON name in struct order.
+func Merge3[T any](base, ours, theirs T) (T, []Conflict) {
+	merged := ours
+	var conflicts []Conflict
+
+	mv := reflect.ValueOf(&merged).Elem()
+	if mv.Kind() != reflect.Struct {
+		return merged, nil
+	}
+	bv, ov, tv := reflect.ValueOf(base), reflect.ValueOf(ours), reflect.ValueOf(theirs)
+
+	for i := 0; i < mv.NumField(); i++ {
+		name, ok := jsonName(mv.Type().Field(i))
+		if !ok {
+			continue
+		}
+		b, o, t := plain(bv.Field(i)), plain(ov.Field(i)), plain(tv.Field(i))
+		switch {
+		case reflect.DeepEqual(o, t), reflect.DeepEqual(b, t):
+			// Same on both sides, or only ours changed: keep ours
+		case reflect.DeepEqual(b, o):
+			mv.Field(i).Set(tv.Field(i))
+		default:
+			conflicts = append(conflicts, Conflict{Field: name, Base: b, Ours: o, Theirs: t})
+		}
+	}
+	return merged, conflicts
+}
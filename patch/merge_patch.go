@@ -0,0 +1,96 @@
+package patch
+
+import "encoding/json"
+
+// ApplyMergePatch applies a JSON Merge Patch (RFC 7396) to doc
+func ApplyMergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeDocument(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+// InvertMergePatch returns the merge patch that restores doc after patch has
+// been applied to it. Merge patches cannot express null values, so members
+// that were null in doc and changed by patch are removed rather than restored.
+func InvertMergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeDocument(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(invertMergePatch(target, p))
+}
+
+func mergePatch(target, patch any) any {
+	pm, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]any)
+	if !ok {
+		tm = make(map[string]any)
+	}
+	for name, value := range pm {
+		if value == nil {
+			delete(tm, name)
+		} else {
+			tm[name] = mergePatch(tm[name], value)
+		}
+	}
+	return tm
+}
+
+func invertMergePatch(target, patch any) any {
+	pm, ok := patch.(map[string]any)
+	if !ok {
+		// The patch replaced the whole document
+		return target
+	}
+	tm, ok := target.(map[string]any)
+	if !ok {
+		return target
+	}
+
+	inverse := make(map[string]any)
+	for name, value := range pm {
+		prior, existed := tm[name]
+		switch {
+		case !existed:
+			// Added members are removed again; removing a missing member is a no-op
+			if value != nil {
+				inverse[name] = nil
+			}
+		case isObject(prior) && isObject(value):
+			inverse[name] = invertMergePatch(prior, value)
+		default:
+			inverse[name] = prior
+		}
+	}
+	return inverse
+}
+
+func isObject(v any) bool {
+	_, ok := v.(map[string]any)
+	return ok
+}
+
+// decodeDocument decodes a JSON document, treating empty input as null
+func decodeDocument(b []byte) (any, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,67 @@
+package patch_test
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+)
+
+func TestMerge3_DisjointPatches(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+
+	for run := 0; run < propertyRuns; run++ {
+		base := randomUser(rng)
+		a, b := randomPatch(rng), randomPatch(rng)
+		// Give each field to at most one side
+		a.Name, a.Phone, a.Bio = patch.Optional[string]{}, patch.Optional[string]{}, patch.Optional[string]{}
+		b.Age, b.Active, b.Role, b.Score = patch.Optional[int]{}, patch.Optional[bool]{}, patch.Optional[string]{}, patch.Optional[float64]{}
+
+		ours, theirs := base, base
+		patch.Apply(&ours, a)
+		patch.Apply(&theirs, b)
+
+		merged, conflicts := patch.Merge3(base, ours, theirs)
+		if len(conflicts) > 0 {
+			t.Fatalf("run %d: unexpected conflicts for disjoint patches: %+v", run, conflicts)
+		}
+
+		expected := base
+		patch.Apply(&expected, patch.Compose(a, b))
+		if !reflect.DeepEqual(merged, expected) {
+			t.Fatalf("run %d: expected %+v, got %+v", run, expected, merged)
+		}
+	}
+}
+
+func TestMerge3_Conflicts(t *testing.T) {
+	phone := "1234567890"
+	base := models.User{Name: "Base", Age: 30, Phone: &phone, Bio: "Bio"}
+
+	ours := base
+	ours.Name = "Ours"
+	ours.Age = 31
+	ours.Bio = "Same"
+
+	theirs := base
+	theirs.Name = "Theirs"
+	theirs.Phone = nil
+	theirs.Bio = "Same"
+
+	merged, conflicts := patch.Merge3(base, ours, theirs)
+
+	if len(conflicts) != 1 {
+		t.Fatalf("Expected a single conflict, got %+v", conflicts)
+	}
+	c := conflicts[0]
+	if c.Field != "name" || c.Base != "Base" || c.Ours != "Ours" || c.Theirs != "Theirs" {
+		t.Errorf("Unexpected conflict: %+v", c)
+	}
+
+	// Non-conflicting changes from both sides are merged
+	if merged.Age != 31 || merged.Phone != nil || merged.Bio != "Same" {
+		t.Errorf("Expected age from ours, phone from theirs and the shared bio, got %+v", merged)
+	}
+}
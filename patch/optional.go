@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
 )
 
 // OptionalAny is an interface for any Optional type to enable type-agnostic validation
@@ -20,6 +21,16 @@ type Optional[T any] struct {
 	value T
 }
 
+// Some returns an Optional set to value
+func Some[T any](value T) Optional[T] {
+	return Optional[T]{set: true, value: value}
+}
+
+// Null returns an Optional explicitly set to null
+func Null[T any]() Optional[T] {
+	return Optional[T]{set: true, null: true}
+}
+
 func (o *Optional[T]) UnmarshalJSON(b []byte) error {
 	o.set = true
 
@@ -60,6 +71,65 @@ func (o Optional[T]) String() string {
 	}
 }
 
+// States of an Optional, as reported by States
+const (
+	StateUnset = "unset"
+	StateNull  = "null"
+	StateValue = "value"
+)
+
+// States returns the state of every Optional field of p, a struct or a
+// pointer to one, keyed by JSON name
+func States(p any) map[string]string {
+	states := map[string]string{}
+	pv := reflect.Indirect(reflect.ValueOf(p))
+	if pv.Kind() != reflect.Struct {
+		return states
+	}
+	for i := 0; i < pv.NumField(); i++ {
+		field := pv.Type().Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		oa, ok := pv.Field(i).Interface().(OptionalAny)
+		switch {
+		case !ok:
+		case !oa.IsSet():
+			states[name] = StateUnset
+		case oa.IsNull():
+			states[name] = StateNull
+		default:
+			states[name] = StateValue
+		}
+	}
+	return states
+}
+
+// optionalSetter lets the package build Optionals of any T through reflection
+type optionalSetter interface {
+	setAny(v interface{}) error
+	setNull()
+	unset()
+}
+
+func (o *Optional[T]) setAny(v interface{}) error {
+	value, ok := v.(T)
+	if !ok {
+		rv := reflect.ValueOf(v)
+		t := reflect.TypeOf(&value).Elem()
+		if !rv.IsValid() || !rv.Type().ConvertibleTo(t) {
+			return fmt.Errorf("cannot use %T as %s", v, t)
+		}
+		value = rv.Convert(t).Interface().(T)
+	}
+	*o = Some(value)
+	return nil
+}
+
+func (o *Optional[T]) setNull() { *o = Null[T]() }
+func (o *Optional[T]) unset()   { *o = Optional[T]{} }
+
 func SetUpdate[T any](m map[string]any, column string, o Optional[T]) {
 	if !o.IsSet() {
 		return
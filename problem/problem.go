@@ -0,0 +1,36 @@
+// Package problem writes problem details responses (RFC 9457), the JSON
+// error format used for unexpected server errors
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentType is the media type of problem details documents
+const ContentType = "application/problem+json"
+
+// Details is a problem details document. Type is about:blank for problems
+// that are fully described by their status. RequestID is an extension member
+// naming the request in the logs.
+type Details struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// New returns the details of a problem that is described by its status
+func New(status int, detail string) Details {
+	return Details{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+// Write responds with d, using its status
+func Write(w http.ResponseWriter, d Details) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(d.Status)
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,185 @@
+// Package redact masks personal data, such as email addresses and phone
+// numbers, before it is written to logs, audit output or error messages.
+//
+// Which fields hold personal data is declared with a redact struct tag
+// naming how the field is masked:
+//
+//	Email string `json:"email" redact:"email"`
+//
+// - email => the first character of the local part and the domain are kept:
+// j***@example.com
+// - phone => only the last 4 digits are kept: ***4567
+// - full  => the whole value is replaced: [REDACTED]
+//
+// Emails and phone numbers are also scrubbed from free text, such as
+// database errors, when a field of that kind is tagged.
+package redact
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang-http-patch/patch"
+)
+
+// Tag is the struct tag that marks a field as personal data
+const Tag = "redact"
+
+// Mask kinds, the values of the redact tag
+const (
+	KindEmail = "email"
+	KindPhone = "phone"
+	KindFull  = "full"
+)
+
+// Redacted replaces values masked in full
+const Redacted = "[REDACTED]"
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+?\(?\d[\d ().-]{5,}\d`)
+)
+
+// minPhoneDigits is how many digits a number in free text needs to be taken
+// for a phone number, the minimum length of a valid one. This errs on the
+// side of masking: long timestamps are masked too.
+const minPhoneDigits = 10
+
+// Rules maps the JSON names of fields holding personal data to their mask
+// kind
+type Rules map[string]string
+
+// For returns the rules declared by the redact tags of model, a struct or a
+// pointer to one. Fields are keyed by their JSON name, like patch.Diff keys
+// them.
+func For(model any) Rules {
+	rules := Rules{}
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return rules
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		kind, ok := field.Tag.Lookup(Tag)
+		if !ok || !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		rules[name] = kind
+	}
+	return rules
+}
+
+// Value masks v if field holds personal data. Null values are kept, since
+// they reveal nothing.
+func (r Rules) Value(field string, v any) any {
+	kind, ok := r[field]
+	if !ok || v == nil {
+		return v
+	}
+	if p, isPointer := v.(*string); isPointer {
+		if p == nil {
+			return nil
+		}
+		v = *p
+	}
+	s, isString := v.(string)
+	if !isString {
+		return Redacted
+	}
+	return mask(kind, s)
+}
+
+// Changes returns a copy of c with the values of personal data fields masked
+func (r Rules) Changes(c patch.Changes) patch.Changes {
+	if c == nil {
+		return nil
+	}
+	masked := make(patch.Changes, len(c))
+	for name, change := range c {
+		masked[name] = patch.Change{From: r.Value(name, change.From), To: r.Value(name, change.To)}
+	}
+	return masked
+}
+
+// Text masks the emails and phone numbers found in s, for the kinds used by
+// the rules
+func (r Rules) Text(s string) string {
+	if r.uses(KindEmail) {
+		s = emailPattern.ReplaceAllStringFunc(s, email)
+	}
+	if r.uses(KindPhone) {
+		s = phonePattern.ReplaceAllStringFunc(s, func(match string) string {
+			if digits(match) < minPhoneDigits {
+				return match
+			}
+			return phone(match)
+		})
+	}
+	return s
+}
+
+func (r Rules) uses(kind string) bool {
+	for _, k := range r {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func mask(kind, s string) string {
+	if s == "" {
+		return s
+	}
+	switch kind {
+	case KindEmail:
+		return email(s)
+	case KindPhone:
+		return phone(s)
+	}
+	return Redacted
+}
+
+func email(s string) string {
+	local, domain, ok := strings.Cut(s, "@")
+	if !ok || local == "" {
+		return Redacted
+	}
+	_, size := utf8.DecodeRuneInString(local)
+	return local[:size] + "***@" + domain
+}
+
+func phone(s string) string {
+	var last []byte
+	for i := len(s) - 1; i >= 0 && len(last) < 4; i-- {
+		if s[i] >= '0' && s[i] <= '9' {
+			last = append([]byte{s[i]}, last...)
+		}
+	}
+	if digits(s) <= len(last) {
+		return Redacted
+	}
+	return "***" + string(last)
+}
+
+func digits(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package redact_test
+
+import (
+	"reflect"
+	"testing"
+
+	"golang-http-patch/patch"
+	"golang-http-patch/redact"
+)
+
+type account struct {
+	Email    string  `json:"email" redact:"email"`
+	Phone    *string `json:"phone,omitempty" redact:"phone"`
+	Secret   int     `json:"secret" redact:"full"`
+	Nickname string  `redact:"full"`
+	Name     string  `json:"name"`
+	Hidden   string  `json:"-" redact:"full"`
+}
+
+func TestFor(t *testing.T) {
+	want := redact.Rules{"email": "email", "phone": "phone", "secret": "full", "Nickname": "full"}
+	if got := redact.For(&account{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestRules_Value(t *testing.T) {
+	rules := redact.For(account{})
+	phone := "+1 (555) 867-5309"
+	tests := []struct {
+		field string
+		value any
+		want  any
+	}{
+		{"email", "jane.doe@example.com", "j***@example.com"},
+		{"email", "ünïcode@example.com", "ü***@example.com"},
+		{"email", "not an email", redact.Redacted},
+		{"email", "", ""},
+		{"phone", phone, "***5309"},
+		{"phone", &phone, "***5309"},
+		{"phone", (*string)(nil), nil},
+		{"phone", "123", redact.Redacted},
+		{"phone", nil, nil},
+		{"secret", 42, redact.Redacted},
+		{"name", "Jane Doe", "Jane Doe"},
+	}
+	for _, tt := range tests {
+		if got := rules.Value(tt.field, tt.value); got != tt.want {
+			t.Errorf("Value(%q, %v) = %v, want %v", tt.field, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRules_Changes(t *testing.T) {
+	changes := patch.Changes{
+		"email": {From: "old@example.com", To: "new@example.com"},
+		"phone": {From: nil, To: "5558675309"},
+		"name":  {From: "Old", To: "New"},
+	}
+	want := patch.Changes{
+		"email": {From: "o***@example.com", To: "n***@example.com"},
+		"phone": {From: nil, To: "***5309"},
+		"name":  {From: "Old", To: "New"},
+	}
+	if got := redact.For(account{}).Changes(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if changes["email"].To != "new@example.com" {
+		t.Error("Expected the changes to be left untouched")
+	}
+}
+
+func TestRules_Text(t *testing.T) {
+	rules := redact.For(account{})
+	tests := map[string]string{
+		"UNIQUE constraint failed: users.email":                     "UNIQUE constraint failed: users.email",
+		"duplicate key jane.doe@example.com":                        "duplicate key j***@example.com",
+		"value +1 (555) 867-5309 too long":                          "value ***5309 too long",
+		"phone 555.867.5309, email a@b.io":                          "phone ***5309, email a***@b.io",
+		"user 42 at version 7 of 2024-01-02":                        "user 42 at version 7 of 2024-01-02",
+		"request body exceeds 1048576 bytes":                        "request body exceeds 1048576 bytes",
+		"already masked j***@example.com and ***5309 stay the same": "already masked j***@example.com and ***5309 stay the same",
+	}
+	for text, want := range tests {
+		if got := rules.Text(text); got != want {
+			t.Errorf("Text(%q) = %q, want %q", text, got, want)
+		}
+	}
+
+	// Only kinds that are tagged are scrubbed from text
+	emailOnly := redact.Rules{"email": redact.KindEmail}
+	if got := emailOnly.Text("call 5558675309"); got != "call 5558675309" {
+		t.Errorf("Expected phone numbers to be kept without phone fields, got %q", got)
+	}
+}
@@ -0,0 +1,375 @@
+package repository_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang-http-patch/models"
+	"golang-http-patch/repository"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestGORMRepository(t *testing.T) {
+	testUserRepository(t, func(t *testing.T) repository.UserRepository {
+		db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+		if err != nil {
+			t.Fatalf("Failed to connect to test database: %v", err)
+		}
+		sqlDB, _ := db.DB()
+		sqlDB.SetMaxOpenConns(1) // every :memory: connection is a separate database
+		if err := models.AutoMigrate(db); err != nil {
+			t.Fatalf("Failed to migrate test database: %v", err)
+		}
+		return repository.NewGORM(db)
+	})
+}
+
+func TestMemoryRepository(t *testing.T) {
+	testUserRepository(t, func(t *testing.T) repository.UserRepository {
+		return repository.NewMemory()
+	})
+}
+
+// testUserRepository is the conformance suite every UserRepository must pass
+func testUserRepository(t *testing.T, newRepo func(t *testing.T) repository.UserRepository) {
+	ctx := context.Background()
+	phone := "1234567890"
+
+	// seed creates a user with every field set
+	seed := func(t *testing.T, repo repository.UserRepository) models.User {
+		p := phone
+		user := models.User{Name: "Jane Doe", Email: "jane@example.com", Age: 30, Phone: &p, Active: true, Bio: "Bio", Role: "admin", Score: 50}
+		if _, err := repo.Create(ctx, &user, "tester"); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		return user
+	}
+
+	t.Run("CreateAndGet", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+		if user.ID == 0 {
+			t.Fatal("Expected an ID to be assigned")
+		}
+
+		got, err := repo.Get(ctx, user.ID)
+		if err != nil || !reflect.DeepEqual(got, user) {
+			t.Errorf("Expected %+v, got %+v (%v)", user, got, err)
+		}
+		if _, err := repo.Get(ctx, 999); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("CreateDefaultsAndFalseActive", func(t *testing.T) {
+		repo := newRepo(t)
+		user := models.User{Name: "Inactive", Email: "inactive@example.com", Age: 20}
+		entry, err := repo.Create(ctx, &user, "tester")
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		got, _ := repo.Get(ctx, user.ID)
+		if got.Active || got.Role != "user" || got.Phone != nil {
+			t.Errorf("Expected inactive user with default role and no phone, got %+v", got)
+		}
+		if entry.Version != 1 || entry.Operation != models.OperationCreate || entry.Actor != "tester" {
+			t.Errorf("Expected create recorded as version 1, got %+v", entry)
+		}
+	})
+
+	t.Run("CreateAtID", func(t *testing.T) {
+		repo := newRepo(t)
+		user := models.User{ID: 42, Name: "At ID", Email: "at-id@example.com", Age: 20}
+		if _, err := repo.Create(ctx, &user, "tester"); err != nil || user.ID != 42 {
+			t.Fatalf("Expected user created at ID 42, got %d (%v)", user.ID, err)
+		}
+		again := models.User{ID: 42, Name: "Again", Email: "again@example.com", Age: 20}
+		if _, err := repo.Create(ctx, &again, "tester"); !errors.Is(err, repository.ErrExists) {
+			t.Errorf("Expected ErrExists, got %v", err)
+		}
+		next := models.User{Name: "Next", Email: "next@example.com", Age: 20}
+		repo.Create(ctx, &next, "tester")
+		if next.ID <= 42 {
+			t.Errorf("Expected the next ID after 42, got %d", next.ID)
+		}
+	})
+
+	t.Run("CreateDuplicateEmail", func(t *testing.T) {
+		repo := newRepo(t)
+		seed(t, repo)
+
+		again := models.User{Name: "Again", Email: "jane@example.com", Age: 20}
+		if _, err := repo.Create(ctx, &again, "tester"); !errors.Is(err, repository.ErrEmailTaken) {
+			t.Errorf("Expected ErrEmailTaken, got %v", err)
+		}
+		if users, _ := repo.List(ctx); len(users) != 1 {
+			t.Errorf("Expected only the first user, got %+v", users)
+		}
+	})
+
+	t.Run("GetVersion", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		var dto models.PatchUserDTO
+		json.Unmarshal([]byte(`{"age": 31}`), &dto)
+		repo.Patch(ctx, user.ID, dto, models.OperationPatch, "editor", nil)
+		got, version, err := repo.GetVersion(ctx, user.ID)
+		if err != nil || version != 2 || got.Age != 31 {
+			t.Errorf("Expected the patched user at version 2, got %+v at %d (%v)", got, version, err)
+		}
+		if _, _, err := repo.GetVersion(ctx, 999); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+		other := models.User{Name: "Other", Email: "other@example.com", Age: 20}
+		repo.Create(ctx, &other, "tester")
+		for _, body := range []string{`{"age": 31}`, `{"age": 32}`} {
+			var dto models.PatchUserDTO
+			json.Unmarshal([]byte(body), &dto)
+			repo.Patch(ctx, user.ID, dto, models.OperationPatch, "editor", nil)
+		}
+
+		versions := func(entries []models.UserHistory) []uint {
+			var v []uint
+			for _, entry := range entries {
+				v = append(v, entry.Version)
+			}
+			return v
+		}
+		entries, total, err := repo.History(ctx, user.ID, 0, 2)
+		if err != nil || total != 3 || !reflect.DeepEqual(versions(entries), []uint{3, 2}) {
+			t.Errorf("Expected versions [3 2] of 3, got %v of %d (%v)", versions(entries), total, err)
+		}
+		if entries, _, _ := repo.History(ctx, user.ID, 1, 0); !reflect.DeepEqual(versions(entries), []uint{2, 1}) {
+			t.Errorf("Expected versions [2 1] after the offset, got %v", versions(entries))
+		}
+		if entries, total, err := repo.History(ctx, user.ID, 5, 2); err != nil || entries == nil || len(entries) != 0 || total != 3 {
+			t.Errorf("Expected an empty page of 3 entries, got %v of %d (%v)", entries, total, err)
+		}
+
+		repo.Delete(ctx, user.ID, "remover")
+		if entries, _, _ := repo.History(ctx, user.ID, 0, 1); len(entries) != 1 || entries[0].Operation != models.OperationDelete {
+			t.Errorf("Expected the history to outlive the user, got %+v", entries)
+		}
+	})
+
+	t.Run("HistorySince", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+		other := models.User{Name: "Other", Email: "other@example.com", Age: 20}
+		repo.Create(ctx, &other, "tester")
+		var dto models.PatchUserDTO
+		json.Unmarshal([]byte(`{"age": 31}`), &dto)
+		repo.Patch(ctx, user.ID, dto, models.OperationPatch, "editor", nil)
+
+		all, err := repo.HistorySince(ctx, 0, 0)
+		if err != nil || len(all) != 3 {
+			t.Fatalf("Expected 3 entries, got %+v (%v)", all, err)
+		}
+		for i := 1; i < len(all); i++ {
+			if all[i].ID <= all[i-1].ID {
+				t.Errorf("Expected entries in ID order, got %+v", all)
+			}
+		}
+		if all[1].UserID != other.ID || all[2].Operation != models.OperationPatch {
+			t.Errorf("Expected the entries of every user in commit order, got %+v", all)
+		}
+
+		entries, err := repo.HistorySince(ctx, all[0].ID, 1)
+		if err != nil || len(entries) != 1 || entries[0].ID != all[1].ID {
+			t.Errorf("Expected only the entry after %d, got %+v (%v)", all[0].ID, entries, err)
+		}
+		if entries, err := repo.HistorySince(ctx, all[2].ID, 0); err != nil || entries == nil || len(entries) != 0 {
+			t.Errorf("Expected no entries after the latest, got %v (%v)", entries, err)
+		}
+	})
+
+	t.Run("Preview", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		var dto models.PatchUserDTO
+		json.Unmarshal([]byte(`{"name": "Previewed", "phone": null, "role": null}`), &dto)
+		before, after, err := repo.Preview(ctx, user.ID, dto)
+		if err != nil || !reflect.DeepEqual(before, user) {
+			t.Fatalf("Expected the stored user before, got %+v (%v)", before, err)
+		}
+		expected := user
+		expected.Name, expected.Phone, expected.Role = "Previewed", nil, ""
+		if !reflect.DeepEqual(after, expected) {
+			t.Errorf("Expected %+v after, got %+v", expected, after)
+		}
+		if got, version, _ := repo.GetVersion(ctx, user.ID); !reflect.DeepEqual(got, user) || version != 1 {
+			t.Errorf("Expected nothing written, got %+v at version %d", got, version)
+		}
+		if _, _, err := repo.Preview(ctx, 999, dto); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		repo := newRepo(t)
+		if users, err := repo.List(ctx); err != nil || len(users) != 0 {
+			t.Fatalf("Expected empty list, got %+v (%v)", users, err)
+		}
+		for _, email := range []string{"c@example.com", "a@example.com", "b@example.com"} {
+			repo.Create(ctx, &models.User{Name: "User", Email: email, Age: 20}, "tester")
+		}
+		users, _ := repo.List(ctx)
+		if len(users) != 3 || users[0].ID > users[1].ID || users[1].ID > users[2].ID || users[0].Email != "c@example.com" {
+			t.Errorf("Expected 3 users ordered by ID, got %+v", users)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		replacement := models.User{ID: user.ID, Name: "Replaced", Email: "ignored@example.com", Age: 31, Active: false, Role: "guest", Score: 10}
+		entry, err := repo.Replace(ctx, &replacement, "editor")
+		if err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		expected := models.User{ID: user.ID, Name: "Replaced", Email: "jane@example.com", Age: 31, Role: "guest", Score: 10}
+		if got, _ := repo.Get(ctx, user.ID); !reflect.DeepEqual(got, expected) || !reflect.DeepEqual(replacement, expected) {
+			t.Errorf("Expected %+v with the email kept, got %+v", expected, got)
+		}
+		if entry.Version != 2 || entry.Operation != models.OperationUpdate || entry.Actor != "editor" {
+			t.Errorf("Expected update recorded as version 2, got %+v", entry)
+		}
+		if _, ok := entry.Diff["email"]; ok {
+			t.Errorf("Expected email not to change, got diff %v", entry.Diff)
+		}
+
+		if entry, _ := repo.Replace(ctx, &replacement, "editor"); entry.ID != 0 {
+			t.Errorf("Expected an unchanged replace not to be recorded, got %+v", entry)
+		}
+		missing := models.User{ID: 999, Name: "Missing", Age: 1}
+		if _, err := repo.Replace(ctx, &missing, "editor"); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("PatchTriState", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		// name and age unset, score set, phone, bio, active and role null
+		var dto models.PatchUserDTO
+		json.Unmarshal([]byte(`{"score": 75.5, "phone": null, "bio": null, "active": null, "role": null}`), &dto)
+		patched, entry, err := repo.Patch(ctx, user.ID, dto, models.OperationPatch, "editor", nil)
+		if err != nil {
+			t.Fatalf("Patch failed: %v", err)
+		}
+
+		expected := models.User{ID: user.ID, Name: "Jane Doe", Email: "jane@example.com", Age: 30, Score: 75.5}
+		if got, _ := repo.Get(ctx, user.ID); !reflect.DeepEqual(got, expected) || !reflect.DeepEqual(patched, expected) {
+			t.Errorf("Expected %+v, got stored %+v and returned %+v", expected, got, patched)
+		}
+		if entry.Version != 2 || entry.Operation != models.OperationPatch || entry.Actor != "editor" {
+			t.Errorf("Expected patch recorded as version 2, got %+v", entry)
+		}
+		fields := []string{"active", "bio", "phone", "role", "score"}
+		if got := entry.Diff.Fields(); !reflect.DeepEqual(got, fields) {
+			t.Errorf("Expected diff of %v, got %v", fields, got)
+		}
+	})
+
+	t.Run("PatchNoOp", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		var dto models.PatchUserDTO
+		json.Unmarshal([]byte(`{"name": "Jane Doe", "age": 30}`), &dto)
+		patched, entry, err := repo.Patch(ctx, user.ID, dto, models.OperationRevert, "editor", nil)
+		if err != nil || entry.ID != 0 || entry.Version != 1 || !reflect.DeepEqual(patched, user) {
+			t.Errorf("Expected unchanged user and no history entry at version 1, got %+v %+v (%v)", patched, entry, err)
+		}
+
+		json.Unmarshal([]byte(`{"age": 31}`), &dto)
+		if _, entry, _ := repo.Patch(ctx, user.ID, dto, models.OperationRevert, "editor", nil); entry.Version != 2 || entry.Operation != models.OperationRevert {
+			t.Errorf("Expected revert recorded as version 2 after the no-op, got %+v", entry)
+		}
+		if _, _, err := repo.Patch(ctx, 999, dto, models.OperationPatch, "editor", nil); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("PatchIfVersion", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		var dto models.PatchUserDTO
+		json.Unmarshal([]byte(`{"age": 31}`), &dto)
+		version := uint(1)
+		if _, entry, err := repo.Patch(ctx, user.ID, dto, models.OperationPatch, "editor", &version); err != nil || entry.Version != 2 {
+			t.Fatalf("Expected the patch at version 1 to be recorded as version 2, got %+v (%v)", entry, err)
+		}
+
+		// The user has moved on to version 2, so a second patch at version 1
+		// must not overwrite the first
+		json.Unmarshal([]byte(`{"age": 32}`), &dto)
+		if _, _, err := repo.Patch(ctx, user.ID, dto, models.OperationPatch, "editor", &version); !errors.Is(err, repository.ErrVersionMismatch) {
+			t.Errorf("Expected ErrVersionMismatch, got %v", err)
+		}
+		if got, _ := repo.Get(ctx, user.ID); got.Age != 31 {
+			t.Errorf("Expected age 31 to be kept, got %d", got.Age)
+		}
+	})
+
+	t.Run("PatchNullRequired", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		for _, body := range []string{`{"name": null}`, `{"age": null, "bio": "Kept?"}`} {
+			var dto models.PatchUserDTO
+			json.Unmarshal([]byte(body), &dto)
+			if _, _, err := repo.Patch(ctx, user.ID, dto, models.OperationPatch, "editor", nil); !errors.Is(err, repository.ErrRequired) {
+				t.Errorf("Expected ErrRequired for %s, got %v", body, err)
+			}
+			if _, _, err := repo.Preview(ctx, user.ID, dto); !errors.Is(err, repository.ErrRequired) {
+				t.Errorf("Expected ErrRequired previewing %s, got %v", body, err)
+			}
+		}
+		if got, version, _ := repo.GetVersion(ctx, user.ID); !reflect.DeepEqual(got, user) || version != 1 {
+			t.Errorf("Expected the user unchanged, got %+v at version %d", got, version)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		entry, err := repo.Delete(ctx, user.ID, "remover")
+		if err != nil || entry.Version != 2 || entry.Operation != models.OperationDelete || entry.Diff["email"].From != "jane@example.com" {
+			t.Errorf("Expected delete recorded as version 2, got %+v (%v)", entry, err)
+		}
+		if _, err := repo.Get(ctx, user.ID); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if _, err := repo.Delete(ctx, user.ID, "remover"); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for a second delete, got %v", err)
+		}
+	})
+
+	t.Run("ReturnedUsersAreCopies", func(t *testing.T) {
+		repo := newRepo(t)
+		user := seed(t, repo)
+
+		got, _ := repo.Get(ctx, user.ID)
+		*got.Phone = "0000000000"
+		if again, _ := repo.Get(ctx, user.ID); *again.Phone != phone {
+			t.Errorf("Expected stored phone to be unaffected, got %q", *again.Phone)
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+
+	"gorm.io/gorm"
+)
+
+// errPreview rolls back the transaction of a preview
+var errPreview = errors.New("preview")
+
+// GORMRepository stores users in a SQL database. History entries go to the
+// user_history table and, for webhook delivery, the outbox, in the same
+// transaction as the change.
+type GORMRepository struct {
+	db *gorm.DB
+}
+
+// NewGORM returns a repository backed by db
+func NewGORM(db *gorm.DB) *GORMRepository {
+	return &GORMRepository{db: db}
+}
+
+func (g *GORMRepository) Get(ctx context.Context, id uint) (models.User, error) {
+	var user models.User
+	err := g.db.WithContext(ctx).First(&user, id).Error
+	return user, notFound(err)
+}
+
+func (g *GORMRepository) GetVersion(ctx context.Context, id uint) (models.User, uint, error) {
+	var user models.User
+	var version uint
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, id).Error; err != nil {
+			return notFound(err)
+		}
+		var err error
+		version, err = latestVersion(tx, id)
+		return err
+	})
+	return user, version, err
+}
+
+func (g *GORMRepository) History(ctx context.Context, id uint, offset, limit int) ([]models.UserHistory, int64, error) {
+	entries := []models.UserHistory{}
+	var total int64
+	query := g.db.WithContext(ctx).Model(&models.UserHistory{}).Where("user_id = ?", id)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Order("version DESC").Offset(offset).Find(&entries).Error
+	return entries, total, err
+}
+
+func (g *GORMRepository) HistorySince(ctx context.Context, afterID uint, limit int) ([]models.UserHistory, error) {
+	entries := []models.UserHistory{}
+	query := g.db.WithContext(ctx).Where("id > ?", afterID).Order("id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Find(&entries).Error
+	return entries, err
+}
+
+func (g *GORMRepository) List(ctx context.Context) ([]models.User, error) {
+	users := []models.User{}
+	err := g.db.WithContext(ctx).Order("id").Find(&users).Error
+	return users, err
+}
+
+func (g *GORMRepository) Create(ctx context.Context, user *models.User, actor string) (models.UserHistory, error) {
+	var entry models.UserHistory
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if user.ID != 0 {
+			err := tx.Select("id").First(&models.User{}, user.ID).Error
+			if err == nil {
+				return ErrExists
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+		// The unique index would reject the email too, but with an error
+		// that depends on the driver
+		var taken int64
+		if err := tx.Model(&models.User{}).Where("email = ?", user.Email).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrEmailTaken
+		}
+
+		active := user.Active
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		// GORM replaces a false Active with the column default on create
+		if !active {
+			if err := tx.Model(user).Update("active", false).Error; err != nil {
+				return err
+			}
+		}
+
+		var err error
+		entry, err = record(tx, user.ID, models.OperationCreate, actor, patch.Diff(models.User{}, *user))
+		return err
+	})
+	return entry, err
+}
+
+func (g *GORMRepository) Replace(ctx context.Context, user *models.User, actor string) (models.UserHistory, error) {
+	var entry models.UserHistory
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var before models.User
+		if err := tx.First(&before, user.ID).Error; err != nil {
+			return notFound(err)
+		}
+
+		// Updates writes the new values back into its model, so use a fresh one
+		err := tx.Model(&models.User{ID: user.ID}).Updates(map[string]interface{}{
+			"name":   user.Name,
+			"age":    user.Age,
+			"phone":  user.Phone,
+			"active": user.Active,
+			"bio":    user.Bio,
+			"role":   user.Role,
+			"score":  user.Score,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.First(user, user.ID).Error; err != nil {
+			return err
+		}
+
+		entry, err = record(tx, user.ID, models.OperationUpdate, actor, patch.Diff(before, *user))
+		return err
+	})
+	return entry, err
+}
+
+func (g *GORMRepository) Patch(ctx context.Context, id uint, dto models.PatchUserDTO, operation, actor string, ifVersion *uint) (models.User, models.UserHistory, error) {
+	if err := checkRequired(dto); err != nil {
+		return models.User{}, models.UserHistory{}, err
+	}
+	var user models.User
+	var entry models.UserHistory
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var before models.User
+		if err := tx.First(&before, id).Error; err != nil {
+			return notFound(err)
+		}
+		if ifVersion != nil {
+			version, err := latestVersion(tx, id)
+			if err != nil {
+				return err
+			}
+			if version != *ifVersion {
+				return ErrVersionMismatch
+			}
+		}
+
+		// Apply the patch in memory first so that no-op patches skip the write
+		user = before
+		if err := patch.Apply(&user, dto); err != nil {
+			return err
+		}
+		changes := patch.Diff(before, user)
+		if !changes.Empty() {
+			// The patched copy is what gets stored, so it needs no reload
+			if err := tx.Model(&models.User{ID: id}).Updates(dto.Updates()).Error; err != nil {
+				return err
+			}
+		}
+
+		var err error
+		entry, err = record(tx, id, operation, actor, changes)
+		return err
+	})
+	return user, entry, err
+}
+
+func (g *GORMRepository) Preview(ctx context.Context, id uint, dto models.PatchUserDTO) (before, after models.User, err error) {
+	if err := checkRequired(dto); err != nil {
+		return before, after, err
+	}
+	// The update runs in a transaction that is always rolled back, so that
+	// column defaults and constraints apply as they would to the write
+	err = g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&before, id).Error; err != nil {
+			return notFound(err)
+		}
+		if updates := dto.Updates(); len(updates) > 0 {
+			if err := tx.Model(&models.User{ID: id}).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.First(&after, id).Error; err != nil {
+			return err
+		}
+		return errPreview
+	})
+	if errors.Is(err, errPreview) {
+		err = nil
+	}
+	return before, after, err
+}
+
+func (g *GORMRepository) Delete(ctx context.Context, id uint, actor string) (models.UserHistory, error) {
+	var entry models.UserHistory
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.First(&user, id).Error; err != nil {
+			return notFound(err)
+		}
+		if err := tx.Delete(&user).Error; err != nil {
+			return err
+		}
+
+		var err error
+		entry, err = record(tx, user.ID, models.OperationDelete, actor, patch.Diff(user, models.User{}))
+		return err
+	})
+	return entry, err
+}
+
+// record appends a history entry for a change to a user, and an outbox
+// message for webhooks. Empty diffs are not recorded; the returned entry then
+// only carries the current version.
+func record(tx *gorm.DB, userID uint, operation, actor string, changes patch.Changes) (models.UserHistory, error) {
+	version, err := latestVersion(tx, userID)
+	if err != nil {
+		return models.UserHistory{}, err
+	}
+	if changes.Empty() {
+		return models.UserHistory{UserID: userID, Version: version}, nil
+	}
+
+	entry := models.UserHistory{
+		UserID:    userID,
+		Version:   version + 1,
+		Operation: operation,
+		Actor:     actor,
+		Diff:      changes,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return models.UserHistory{}, err
+	}
+
+	// Queue the change for webhook delivery in the same transaction
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return models.UserHistory{}, err
+	}
+	err = tx.Create(&models.OutboxMessage{Event: operation, Payload: payload}).Error
+	return entry, err
+}
+
+// latestVersion returns the latest history version of a user, 0 if none
+func latestVersion(tx *gorm.DB, userID uint) (uint, error) {
+	var version uint
+	err := tx.Model(&models.UserHistory{}).
+		Where("user_id = ?", userID).
+		Select("COALESCE(MAX(version), 0)").
+		Scan(&version).Error
+	return version, err
+}
+
+// notFound translates GORM's not found error to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
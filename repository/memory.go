@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"golang-http-patch/models"
+	"golang-http-patch/patch"
+)
+
+// MemoryRepository stores users in memory, for fast tests and demos. Its
+// history entries are kept in memory as well and there is no outbox, so
+// webhooks, which read the outbox table, need the GORM repository.
+type MemoryRepository struct {
+	mu       sync.Mutex
+	users    map[uint]models.User
+	nextID   uint
+	versions map[uint]uint // latest history version per user
+	history  []models.UserHistory
+}
+
+// NewMemory returns an empty in-memory repository
+func NewMemory() *MemoryRepository {
+	return &MemoryRepository{
+		users:    make(map[uint]models.User),
+		nextID:   1,
+		versions: make(map[uint]uint),
+	}
+}
+
+func (m *MemoryRepository) Get(ctx context.Context, id uint) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	return clone(user), nil
+}
+
+func (m *MemoryRepository) GetVersion(ctx context.Context, id uint) (models.User, uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok {
+		return models.User{}, 0, ErrNotFound
+	}
+	return clone(user), m.versions[id], nil
+}
+
+func (m *MemoryRepository) History(ctx context.Context, id uint, offset, limit int) ([]models.UserHistory, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var all []models.UserHistory
+	for i := len(m.history) - 1; i >= 0; i-- {
+		if m.history[i].UserID == id {
+			all = append(all, m.history[i])
+		}
+	}
+
+	entries := []models.UserHistory{}
+	if offset < len(all) {
+		entries = all[offset:]
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, int64(len(all)), nil
+}
+
+func (m *MemoryRepository) HistorySince(ctx context.Context, afterID uint, limit int) ([]models.UserHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The entry with ID n is at index n-1
+	entries := []models.UserHistory{}
+	if int(afterID) < len(m.history) {
+		entries = append(entries, m.history[afterID:]...)
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (m *MemoryRepository) List(ctx context.Context) ([]models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]models.User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, clone(user))
+	}
+	slices.SortFunc(users, func(a, b models.User) int { return int(a.ID) - int(b.ID) })
+	return users, nil
+}
+
+func (m *MemoryRepository) Create(ctx context.Context, user *models.User, actor string) (models.UserHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if user.ID == 0 {
+		user.ID = m.nextID
+	}
+	if _, ok := m.users[user.ID]; ok {
+		return models.UserHistory{}, ErrExists
+	}
+	for _, other := range m.users {
+		if other.Email == user.Email {
+			return models.UserHistory{}, ErrEmailTaken
+		}
+	}
+	m.nextID = max(m.nextID, user.ID+1)
+	// Same default as the role column
+	if user.Role == "" {
+		user.Role = "user"
+	}
+
+	m.users[user.ID] = clone(*user)
+	return m.record(user.ID, models.OperationCreate, actor, patch.Diff(models.User{}, *user)), nil
+}
+
+func (m *MemoryRepository) Replace(ctx context.Context, user *models.User, actor string) (models.UserHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before, ok := m.users[user.ID]
+	if !ok {
+		return models.UserHistory{}, ErrNotFound
+	}
+
+	user.Email = before.Email
+	m.users[user.ID] = clone(*user)
+	return m.record(user.ID, models.OperationUpdate, actor, patch.Diff(before, *user)), nil
+}
+
+func (m *MemoryRepository) Patch(ctx context.Context, id uint, dto models.PatchUserDTO, operation, actor string, ifVersion *uint) (models.User, models.UserHistory, error) {
+	if err := checkRequired(dto); err != nil {
+		return models.User{}, models.UserHistory{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before, ok := m.users[id]
+	if !ok {
+		return models.User{}, models.UserHistory{}, ErrNotFound
+	}
+	if ifVersion != nil && m.versions[id] != *ifVersion {
+		return models.User{}, models.UserHistory{}, ErrVersionMismatch
+	}
+
+	user := clone(before)
+	if err := patch.Apply(&user, dto); err != nil {
+		return before, models.UserHistory{}, err
+	}
+	m.users[id] = user
+	return clone(user), m.record(id, operation, actor, patch.Diff(before, user)), nil
+}
+
+func (m *MemoryRepository) Preview(ctx context.Context, id uint, dto models.PatchUserDTO) (before, after models.User, err error) {
+	if err := checkRequired(dto); err != nil {
+		return before, after, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[id]
+	if !ok {
+		return before, after, ErrNotFound
+	}
+	after = clone(stored)
+	if err := patch.Apply(&after, dto); err != nil {
+		return before, after, err
+	}
+	return clone(stored), after, nil
+}
+
+func (m *MemoryRepository) Delete(ctx context.Context, id uint, actor string) (models.UserHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok {
+		return models.UserHistory{}, ErrNotFound
+	}
+	delete(m.users, id)
+	return m.record(id, models.OperationDelete, actor, patch.Diff(user, models.User{})), nil
+}
+
+// record appends a history entry. Empty diffs are not recorded; the returned
+// entry then only carries the current version.
+func (m *MemoryRepository) record(userID uint, operation, actor string, changes patch.Changes) models.UserHistory {
+	if changes.Empty() {
+		return models.UserHistory{UserID: userID, Version: m.versions[userID]}
+	}
+	m.versions[userID]++
+	entry := models.UserHistory{
+		ID:        uint(len(m.history) + 1),
+		UserID:    userID,
+		Version:   m.versions[userID],
+		Operation: operation,
+		Actor:     actor,
+		Diff:      changes,
+		CreatedAt: time.Now(),
+	}
+	m.history = append(m.history, entry)
+	return entry
+}
+
+// clone copies a user so that callers never share the stored phone pointer
+func clone(user models.User) models.User {
+	if user.Phone != nil {
+		phone := *user.Phone
+		user.Phone = &phone
+	}
+	return user
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang-http-patch/models"
+)
+
+// Errors returned by every UserRepository
+var (
+	ErrNotFound        = errors.New("user not found")
+	ErrExists          = errors.New("user already exists")
+	ErrVersionMismatch = errors.New("user version changed")
+	ErrEmailTaken      = errors.New("email already in use")
+	ErrRequired        = errors.New("required field cannot be null")
+)
+
+// UserRepository stores users. Every write is recorded as a history entry
+// atomically with the change, and the entry is returned so that the caller
+// can publish it; the entry has a zero ID when nothing changed, and its
+// Version is the version of the user after the write either way. Email is
+// immutable and only set on Create.
+type UserRepository interface {
+	// Get returns the user with id, or ErrNotFound
+	Get(ctx context.Context, id uint) (models.User, error)
+
+	// GetVersion returns the user with id together with its latest history
+	// version, read consistently, or ErrNotFound. Versions of a user are
+	// numbered from 1 without gaps; a user without history is at version 0.
+	GetVersion(ctx context.Context, id uint) (models.User, uint, error)
+
+	// History returns the history entries of the user with id, newest first,
+	// skipping offset entries and returning at most limit (all if limit is
+	// 0), and the total number of entries. Deleted users keep their history.
+	History(ctx context.Context, id uint, offset, limit int) ([]models.UserHistory, int64, error)
+
+	// HistorySince returns the history entries of all users with an ID
+	// greater than afterID, in ID order, at most limit of them (all if limit
+	// is 0). Entry IDs increase with every recorded change.
+	HistorySince(ctx context.Context, afterID uint, limit int) ([]models.UserHistory, error)
+
+	// List returns all users ordered by ID
+	List(ctx context.Context) ([]models.User, error)
+
+	// Create stores user, assigning an ID unless it has one, and fills in
+	// the stored values. It returns ErrExists when the ID is taken and
+	// ErrEmailTaken when the email is.
+	Create(ctx context.Context, user *models.User, actor string) (models.UserHistory, error)
+
+	// Replace overwrites every mutable field of the user with user.ID and
+	// fills in the stored values. It returns ErrNotFound when there is none.
+	Replace(ctx context.Context, user *models.User, actor string) (models.UserHistory, error)
+
+	// Patch applies dto to the user with id with tri-state semantics (unset
+	// fields are kept, null fields are cleared) and records the change under
+	// operation. If ifVersion is not nil, the user must still be at that
+	// version when the change is written, or nothing is written and
+	// ErrVersionMismatch is returned. It returns the patched user, or
+	// ErrNotFound, or ErrRequired if dto sets name or age to null.
+	Patch(ctx context.Context, id uint, dto models.PatchUserDTO, operation, actor string, ifVersion *uint) (models.User, models.UserHistory, error)
+
+	// Preview returns the user with id before and after dto would be
+	// applied by Patch, without writing or recording anything
+	Preview(ctx context.Context, id uint, dto models.PatchUserDTO) (before, after models.User, err error)
+
+	// Delete removes the user with id, or returns ErrNotFound
+	Delete(ctx context.Context, id uint, actor string) (models.UserHistory, error)
+}
+
+// checkRequired returns ErrRequired if dto clears a column that is NOT NULL
+func checkRequired(dto models.PatchUserDTO) error {
+	switch {
+	case dto.Name.IsNull():
+		return fmt.Errorf("%w: name", ErrRequired)
+	case dto.Age.IsNull():
+		return fmt.Errorf("%w: age", ErrRequired)
+	}
+	return nil
+}
@@ -2,41 +2,71 @@ package validation
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
+	"golang-http-patch/problem"
+
 	"github.com/go-playground/validator/v10"
 )
 
-var Validate *validator.Validate
-
-// InitValidator initializes the validator instance
-func InitValidator() {
-	Validate = validator.New()
-	RegisterPatchValidators(Validate)
+// New returns a validator with the custom patch validators registered
+func New() *validator.Validate {
+	v := validator.New()
+	RegisterPatchValidators(v)
+	return v
 }
 
-// ValidateStruct validates a struct and returns validation errors as JSON
-func ValidateStruct(w http.ResponseWriter, s interface{}) bool {
-	if err := Validate.Struct(s); err != nil {
-		var errors []map[string]string
-		for _, err := range err.(validator.ValidationErrors) {
-			errors = append(errors, map[string]string{
-				"field":   err.Field(),
-				"tag":     err.Tag(),
-				"message": GetValidationMessage(err),
-			})
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error":  "Validation failed",
-			"errors": errors,
-		})
+// ValidateStruct validates a struct and returns validation errors as JSON,
+// see WriteErrors
+func ValidateStruct(v *validator.Validate, w http.ResponseWriter, s interface{}) bool {
+	if err := v.Struct(s); err != nil {
+		WriteErrors(w, err)
 		return false
 	}
 	return true
 }
 
+// WriteErrors responds with the validation errors in err as JSON. A value
+// that could not be validated at all, such as nil, is a bug rather than a bad
+// request and gets a 500 problem response.
+func WriteErrors(w http.ResponseWriter, err error) {
+	if !errors.As(err, new(validator.ValidationErrors)) {
+		problem.Write(w, problem.New(http.StatusInternalServerError, "The request could not be validated"))
+		return
+	}
+	WriteFieldErrors(w, FieldErrors(err))
+}
+
+// WriteFieldErrors responds with field errors in the format of WriteErrors,
+// for rules that are checked outside the validator
+func WriteFieldErrors(w http.ResponseWriter, fields []map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Validation failed",
+		"errors": fields,
+	})
+}
+
+// FieldErrors lists the field, tag and message of every validation error.
+// It returns nil if err is not made of validation errors.
+func FieldErrors(err error) []map[string]string {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return nil
+	}
+	var fields []map[string]string
+	for _, err := range validationErrors {
+		fields = append(fields, map[string]string{
+			"field":   err.Field(),
+			"tag":     err.Tag(),
+			"message": GetValidationMessage(err),
+		})
+	}
+	return fields
+}
+
 // GetValidationMessage returns a user-friendly validation message
 func GetValidationMessage(err validator.FieldError) string {
 	switch err.Tag() {
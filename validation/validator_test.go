@@ -0,0 +1,70 @@
+package validation_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang-http-patch/models"
+	"golang-http-patch/problem"
+	"golang-http-patch/validation"
+)
+
+func TestValidateStruct(t *testing.T) {
+	v := validation.New()
+
+	w := httptest.NewRecorder()
+	if !validation.ValidateStruct(v, w, models.CreateUserDTO{Name: "Jane", Email: "jane@example.com", Age: 30}) {
+		t.Errorf("Expected a valid user to pass, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	if validation.ValidateStruct(v, w, models.CreateUserDTO{Name: "J", Email: "jane@example.com", Age: 30}) {
+		t.Fatal("Expected an invalid user to fail")
+	}
+	var body struct {
+		Error  string              `json:"error"`
+		Errors []map[string]string `json:"errors"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusBadRequest || len(body.Errors) != 1 || body.Errors[0]["field"] != "Name" || body.Errors[0]["tag"] != "min" {
+		t.Errorf("Expected a min error on Name, got %d %+v", w.Code, body)
+	}
+}
+
+func TestValidateStruct_InvalidValue(t *testing.T) {
+	// The validator reports values that are not structs with an
+	// InvalidValidationError rather than ValidationErrors
+	for _, value := range []any{nil, "not a struct", (*models.CreateUserDTO)(nil)} {
+		w := httptest.NewRecorder()
+		if validation.ValidateStruct(validation.New(), w, value) {
+			t.Errorf("Expected %#v to fail", value)
+			continue
+		}
+		var details problem.Details
+		json.NewDecoder(w.Body).Decode(&details)
+		if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") != problem.ContentType || details.Status != http.StatusInternalServerError {
+			t.Errorf("Expected a 500 problem response for %#v, got %d %+v", value, w.Code, details)
+		}
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	v := validation.New()
+	err := v.Struct(models.CreateUserDTO{Email: "not an email", Age: 30})
+
+	// Wrapped validation errors are found too
+	fields := validation.FieldErrors(fmt.Errorf("create user: %w", err))
+	if len(fields) != 2 || fields[0]["field"] != "Name" || fields[1]["field"] != "Email" || fields[1]["message"] != "Email must be a valid email address" {
+		t.Errorf("Expected errors on Name and Email, got %v", fields)
+	}
+
+	if fields := validation.FieldErrors(v.Struct(nil)); fields != nil {
+		t.Errorf("Expected no field errors for an invalid value, got %v", fields)
+	}
+	if fields := validation.FieldErrors(fmt.Errorf("something else")); fields != nil {
+		t.Errorf("Expected no field errors for other errors, got %v", fields)
+	}
+}
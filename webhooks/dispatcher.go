@@ -0,0 +1,250 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang-http-patch/models"
+
+	"gorm.io/gorm"
+)
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "X-Webhook-Signature" // "sha256=" + hex HMAC of timestamp + "." + body
+	TimestampHeader = "X-Webhook-Timestamp" // Unix seconds, part of the signed content
+	EventHeader     = "X-Webhook-Event"     // the operation, e.g. "patch"
+	DeliveryHeader  = "X-Webhook-Delivery"  // delivery ID, stable across retries
+)
+
+// batchSize limits how many outbox messages and deliveries are handled per pass
+const batchSize = 100
+
+// Dispatcher moves outbox messages to registered webhooks. Each message is
+// fanned out into one delivery per webhook, and each delivery is retried with
+// exponential backoff until it succeeds or MaxAttempts is reached, after
+// which it is marked dead.
+type Dispatcher struct {
+	DB          *gorm.DB
+	Client      *http.Client
+	Logger      *slog.Logger
+	Interval    time.Duration // how often the outbox is polled
+	MaxAttempts int
+	BaseBackoff time.Duration // delay after the first failure, doubled after each one
+	MaxBackoff  time.Duration
+
+	now     func() time.Time
+	running atomic.Bool
+}
+
+// NewDispatcher returns a dispatcher with default settings
+func NewDispatcher(db *gorm.DB) *Dispatcher {
+	return &Dispatcher{
+		DB:          db,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Logger:      slog.Default(),
+		Interval:    time.Second,
+		MaxAttempts: 8,
+		BaseBackoff: 5 * time.Second,
+		MaxBackoff:  time.Hour,
+		now:         time.Now,
+	}
+}
+
+// Run dispatches until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.running.Store(true)
+	defer d.running.Store(false)
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			d.Logger.Error("Webhook dispatch failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check reports an error unless Run is running, for readiness checks
+func (d *Dispatcher) Check(context.Context) error {
+	if !d.running.Load() {
+		return errors.New("webhook dispatcher is not running")
+	}
+	return nil
+}
+
+// RunOnce fans out pending outbox messages and attempts every delivery that
+// is due
+func (d *Dispatcher) RunOnce(ctx context.Context) error {
+	if err := d.fanOut(ctx); err != nil {
+		return err
+	}
+
+	var due []models.WebhookDelivery
+	err := d.DB.WithContext(ctx).Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, d.now()).
+		Order("id").Limit(batchSize).Find(&due).Error
+	if err != nil {
+		return err
+	}
+	for _, delivery := range due {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := d.attempt(ctx, delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fanOut creates a delivery for every webhook that is registered when an
+// outbox message is dispatched and whose filters match the change, and marks
+// the message as dispatched
+func (d *Dispatcher) fanOut(ctx context.Context) error {
+	var messages []models.OutboxMessage
+	if err := d.DB.WithContext(ctx).Where("dispatched_at IS NULL").Order("id").Limit(batchSize).Find(&messages).Error; err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var hooks []models.Webhook
+	if err := d.DB.WithContext(ctx).Find(&hooks).Error; err != nil {
+		return err
+	}
+
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := d.now()
+		for _, msg := range messages {
+			var entry models.UserHistory
+			if err := json.Unmarshal(msg.Payload, &entry); err != nil {
+				return err
+			}
+			for _, hook := range hooks {
+				if !hook.Matches(msg.Event, entry.Diff) {
+					continue
+				}
+				err := tx.Create(&models.WebhookDelivery{
+					WebhookID:     hook.ID,
+					OutboxID:      msg.ID,
+					Event:         msg.Event,
+					Status:        models.DeliveryPending,
+					NextAttemptAt: now,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&msg).Update("dispatched_at", now).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// attempt sends a delivery once and records the outcome
+func (d *Dispatcher) attempt(ctx context.Context, delivery models.WebhookDelivery) error {
+	var hook models.Webhook
+	var msg models.OutboxMessage
+	if err := d.DB.WithContext(ctx).First(&hook, delivery.WebhookID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// The webhook was deleted after the message was fanned out
+			return d.DB.WithContext(ctx).Delete(&delivery).Error
+		}
+		return err
+	}
+	if err := d.DB.WithContext(ctx).First(&msg, delivery.OutboxID).Error; err != nil {
+		return err
+	}
+
+	sendErr := d.send(ctx, hook, delivery, msg.Payload)
+	if ctx.Err() != nil {
+		// Cut short by shutdown; the delivery stays due and is not counted
+		return ctx.Err()
+	}
+
+	now := d.now()
+	updates := map[string]interface{}{"attempts": delivery.Attempts + 1}
+	switch {
+	case sendErr == nil:
+		updates["status"] = models.DeliveryDelivered
+		updates["delivered_at"] = now
+		updates["last_error"] = ""
+	case delivery.Attempts+1 >= d.MaxAttempts:
+		updates["status"] = models.DeliveryDead
+		updates["last_error"] = truncate(sendErr.Error(), 500)
+	default:
+		updates["next_attempt_at"] = now.Add(d.backoff(delivery.Attempts + 1))
+		updates["last_error"] = truncate(sendErr.Error(), 500)
+	}
+	return d.DB.WithContext(ctx).Model(&delivery).Updates(updates).Error
+}
+
+// send POSTs the signed payload; any non-2xx response is a failure
+func (d *Dispatcher) send(ctx context.Context, hook models.Webhook, delivery models.WebhookDelivery, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, timestamp, payload))
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt after the given number
+// of failed attempts
+func (d *Dispatcher) backoff(failures int) time.Duration {
+	delay := d.BaseBackoff
+	for i := 1; i < failures && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.MaxBackoff)
+}
+
+// Sign returns the signature header value for a payload sent at timestamp.
+// Receivers recompute it with their secret and compare with hmac.Equal.
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package webhooks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang-http-patch/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// setupDispatcher returns a dispatcher on a fresh database with one webhook
+// pointing at handler, one queued outbox message and a controllable clock
+func setupDispatcher(t *testing.T, handler http.HandlerFunc) (*Dispatcher, *time.Time) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1) // every :memory: connection is a separate database
+	if err := models.AutoMigrate(db); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	receiver := httptest.NewServer(handler)
+	t.Cleanup(receiver.Close)
+
+	db.Create(&models.Webhook{URL: receiver.URL, Secret: "0123456789abcdef"})
+	db.Create(&models.OutboxMessage{Event: models.OperationPatch, Payload: []byte(`{"user_id":1}`)})
+
+	clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	d := NewDispatcher(db)
+	d.BaseBackoff = time.Minute
+	d.MaxBackoff = 3 * time.Minute
+	d.now = func() time.Time { return clock }
+	return d, &clock
+}
+
+func delivery(t *testing.T, d *Dispatcher) models.WebhookDelivery {
+	var deliveries []models.WebhookDelivery
+	d.DB.Find(&deliveries)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestDispatcher_RetriesWithBackoff(t *testing.T) {
+	var calls atomic.Int32
+	d, clock := setupDispatcher(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	ctx := context.Background()
+
+	start := *clock
+	d.RunOnce(ctx)
+	got := delivery(t, d)
+	if got.Status != models.DeliveryPending || got.Attempts != 1 || !got.NextAttemptAt.Equal(start.Add(time.Minute)) {
+		t.Fatalf("Expected retry in 1m after the first failure, got %+v", got)
+	}
+
+	// Not due yet
+	d.RunOnce(ctx)
+	if calls.Load() != 1 {
+		t.Fatalf("Expected no attempt before the backoff elapsed, got %d calls", calls.Load())
+	}
+
+	*clock = got.NextAttemptAt
+	d.RunOnce(ctx)
+	got = delivery(t, d)
+	if got.Attempts != 2 || !got.NextAttemptAt.Equal(clock.Add(2*time.Minute)) || got.LastError == "" {
+		t.Fatalf("Expected retry in 2m after the second failure, got %+v", got)
+	}
+
+	*clock = got.NextAttemptAt
+	d.RunOnce(ctx)
+	got = delivery(t, d)
+	if got.Status != models.DeliveryDelivered || got.Attempts != 3 || got.DeliveredAt == nil || got.LastError != "" {
+		t.Fatalf("Expected delivery on the third attempt, got %+v", got)
+	}
+}
+
+func TestDispatcher_DeadLetter(t *testing.T) {
+	var calls atomic.Int32
+	d, clock := setupDispatcher(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	d.MaxAttempts = 4
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		d.RunOnce(ctx)
+		*clock = clock.Add(time.Hour)
+	}
+
+	got := delivery(t, d)
+	if got.Status != models.DeliveryDead || got.Attempts != 4 || got.LastError != "webhook responded with status 500" {
+		t.Errorf("Expected dead delivery after 4 attempts, got %+v", got)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("Expected 4 calls, got %d", calls.Load())
+	}
+}
+
+func TestDispatcher_Backoff(t *testing.T) {
+	d := &Dispatcher{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, want := range expected {
+		if got := d.backoff(i + 1); got != want {
+			t.Errorf("backoff(%d): expected %v, got %v", i+1, want, got)
+		}
+	}
+}